@@ -0,0 +1,173 @@
+package actionscachetest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// blob endpoint errors use the Azure storage XML error format
+func writeErrorBlob(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>%s</Message></Error>", code, msg)
+}
+
+func (s *Server) handleBlobGet(w http.ResponseWriter, r *http.Request) {
+	if err := s.verifySignature(r, "r"); err != nil {
+		writeErrorBlob(w, http.StatusForbidden, "AuthenticationFailed", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	e := s.entryByID(r.PathValue("id"))
+	var dt []byte
+	found := e != nil && e.committed
+	if found {
+		dt = e.data
+	}
+	s.mu.Unlock()
+
+	if !found {
+		writeErrorBlob(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+
+	rng := r.Header.Get("x-ms-range")
+	if rng == "" {
+		rng = r.Header.Get("Range")
+	}
+	size := int64(len(dt))
+	start, end := int64(0), size-1
+	if rng != "" {
+		var ok bool
+		start, end, ok = parseRange(rng, size)
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			writeErrorBlob(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The range specified is invalid for the current size of the resource.")
+			return
+		}
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("x-ms-request-id", newRequestID())
+	h.Set("x-ms-blob-type", "BlockBlob")
+	h.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if rng != "" {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(dt[start : end+1])
+}
+
+// parseRange parses a single "bytes=start-[end]" range
+func parseRange(v string, size int64) (int64, int64, bool) {
+	v, ok := strings.CutPrefix(v, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	starts, ends, ok := strings.Cut(v, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(starts, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if ends != "" {
+		end, err = strconv.ParseInt(ends, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+func (s *Server) handleBlobPut(w http.ResponseWriter, r *http.Request) {
+	if err := s.verifySignature(r, "w"); err != nil {
+		writeErrorBlob(w, http.StatusForbidden, "AuthenticationFailed", err.Error())
+		return
+	}
+	dt, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeErrorBlob(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entryByID(r.PathValue("id"))
+	if e == nil {
+		writeErrorBlob(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+	if e.committed {
+		writeErrorBlob(w, http.StatusConflict, "BlobImmutableDueToPolicy", "The blob has already been finalized.")
+		return
+	}
+
+	switch comp := r.URL.Query().Get("comp"); comp {
+	case "block":
+		id := r.URL.Query().Get("blockid")
+		if id == "" {
+			writeErrorBlob(w, http.StatusBadRequest, "InvalidQueryParameterValue", "blockid is required")
+			return
+		}
+		e.blocks[id] = dt
+	case "blocklist":
+		var bl struct {
+			Blocks []struct {
+				XMLName xml.Name
+				ID      string `xml:",chardata"`
+			} `xml:",any"`
+		}
+		if err := xml.Unmarshal(dt, &bl); err != nil {
+			writeErrorBlob(w, http.StatusBadRequest, "InvalidXmlDocument", err.Error())
+			return
+		}
+		buf := &bytes.Buffer{}
+		for _, b := range bl.Blocks {
+			blk, ok := e.blocks[b.ID]
+			if !ok {
+				writeErrorBlob(w, http.StatusBadRequest, "InvalidBlockList", fmt.Sprintf("block %s has not been staged", b.ID))
+				return
+			}
+			buf.Write(blk)
+		}
+		e.data = buf.Bytes()
+	case "":
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			writeErrorBlob(w, http.StatusBadRequest, "InvalidHeaderValue", "only block blobs are supported")
+			return
+		}
+		e.data = dt
+	default:
+		writeErrorBlob(w, http.StatusBadRequest, "InvalidQueryParameterValue", fmt.Sprintf("unsupported comp %q", comp))
+		return
+	}
+
+	w.Header().Set("x-ms-request-id", newRequestID())
+	w.Header().Set("ETag", fmt.Sprintf("\"%d-%d\"", e.id, len(e.data)))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,272 @@
+package actionscachetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// registerREST adds the cache management endpoints of the GitHub REST API.
+// They are served both from the root and under the /api/v3 prefix used by
+// GitHub Enterprise Server.
+func (s *Server) registerREST(mux *http.ServeMux) {
+	for _, prefix := range []string{"", "/api/v3"} {
+		repo := prefix + "/repos/{owner}/{repo}/actions"
+		mux.Handle("GET "+repo+"/caches", restAuth(s.handleListCaches))
+		mux.Handle("DELETE "+repo+"/caches", restAuth(s.handleDeleteByKey))
+		mux.Handle("DELETE "+repo+"/caches/{id}", restAuth(s.handleDeleteByID))
+		mux.Handle("GET "+repo+"/cache/usage", restAuth(s.handleUsage))
+		mux.Handle("GET "+repo+"/cache/usage-policy", restAuth(s.handleGetUsagePolicy))
+		mux.Handle("PATCH "+repo+"/cache/usage-policy", restAuth(s.handleSetUsagePolicy))
+
+		org := prefix + "/orgs/{org}/actions/cache"
+		mux.Handle("GET "+org+"/usage", restAuth(s.handleOrgUsage))
+		mux.Handle("GET "+org+"/usage-by-repository", restAuth(s.handleOrgUsageByRepository))
+
+		enterprise := prefix + "/enterprises/{enterprise}/actions/cache"
+		mux.Handle("GET "+enterprise+"/usage-policy", restAuth(s.handleGetEnterprisePolicy))
+		mux.Handle("PATCH "+enterprise+"/usage-policy", restAuth(s.handleSetEnterprisePolicy))
+	}
+}
+
+func restAuth(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); !ok || token == "" {
+			writeErrorREST(w, http.StatusUnauthorized, "Requires authentication")
+			return
+		}
+		h(w, r)
+	})
+}
+
+func writeErrorREST(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{
+		"message":           msg,
+		"documentation_url": "https://docs.github.com/rest/actions/cache",
+	})
+}
+
+func (e *entry) cacheKey() actionscache.CacheKey {
+	return actionscache.CacheKey{
+		ID:           e.id,
+		Ref:          e.scope,
+		Key:          e.key,
+		Version:      e.version,
+		LastAccessed: e.createdAt.UTC().Format(time.RFC3339),
+		CreatedAt:    e.createdAt.UTC().Format(time.RFC3339),
+		SizeInBytes:  len(e.data),
+	}
+}
+
+// pageBounds returns the range of the total items that is on the page
+// requested by r.
+func pageBounds(r *http.Request, total int) (int, int) {
+	q := r.URL.Query()
+	perPage, err := strconv.Atoi(q.Get("per_page"))
+	if err != nil || perPage <= 0 {
+		perPage = 30
+	}
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page <= 0 {
+		page = 1
+	}
+	start := min((page-1)*perPage, total)
+	return start, min(start+perPage, total)
+}
+
+func (s *Server) handleListCaches(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.mu.Lock()
+	var caches []actionscache.CacheKey
+	for _, e := range s.entries {
+		if !e.committed {
+			continue
+		}
+		if k := q.Get("key"); k != "" && !strings.HasPrefix(e.key, k) {
+			continue
+		}
+		if ref := q.Get("ref"); ref != "" && e.scope != ref {
+			continue
+		}
+		caches = append(caches, e.cacheKey())
+	}
+	s.mu.Unlock()
+
+	// newest first, like the default sort of the real API
+	sort.SliceStable(caches, func(i, j int) bool {
+		return caches[i].ID > caches[j].ID
+	})
+	start, end := pageBounds(r, len(caches))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_count":    len(caches),
+		"actions_caches": append([]actionscache.CacheKey{}, caches[start:end]...),
+	})
+}
+
+func (s *Server) handleDeleteByKey(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	ref := r.URL.Query().Get("ref")
+	if key == "" {
+		writeErrorREST(w, http.StatusBadRequest, "key is required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := []actionscache.CacheKey{}
+	s.deleteEntries(func(e *entry) bool {
+		if e.committed && e.key == key && (ref == "" || e.scope == ref) {
+			deleted = append(deleted, e.cacheKey())
+			return true
+		}
+		return false
+	})
+	if len(deleted) == 0 {
+		writeErrorREST(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_count":    len(deleted),
+		"actions_caches": deleted,
+	})
+}
+
+func (s *Server) handleDeleteByID(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entryByID(r.PathValue("id"))
+	if e == nil || !e.committed {
+		writeErrorREST(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	s.deleteEntries(func(e2 *entry) bool {
+		return e2 == e
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteEntries(f func(*entry) bool) {
+	entries := s.entries[:0]
+	for _, e := range s.entries {
+		if !f(e) {
+			entries = append(entries, e)
+		}
+	}
+	s.entries = entries
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	usage := actionscache.RepoCacheUsage{
+		FullName: r.PathValue("owner") + "/" + r.PathValue("repo"),
+	}
+	for _, e := range s.entries {
+		if e.committed {
+			usage.ActiveCachesCount++
+			usage.ActiveCachesSize += int64(len(e.data))
+		}
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, usage)
+}
+
+func (s *Server) handleGetUsagePolicy(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	limit := s.usagePolicy
+	s.mu.Unlock()
+	if limit == 0 {
+		limit = 10
+	}
+	writeJSON(w, http.StatusOK, actionscache.CacheUsagePolicy{RepoCacheSizeLimitGB: limit})
+}
+
+func (s *Server) handleSetUsagePolicy(w http.ResponseWriter, r *http.Request) {
+	var p actionscache.CacheUsagePolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.RepoCacheSizeLimitGB <= 0 {
+		writeErrorREST(w, http.StatusUnprocessableEntity, "Invalid request")
+		return
+	}
+	s.mu.Lock()
+	s.usagePolicy = p.RepoCacheSizeLimitGB
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleOrgUsage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	usages, ok := s.orgUsage[r.PathValue("org")]
+	s.mu.Unlock()
+	if !ok {
+		writeErrorREST(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	var usage actionscache.OrgCacheUsage
+	for _, u := range usages {
+		usage.TotalActiveCachesCount += u.ActiveCachesCount
+		usage.TotalActiveCachesSize += u.ActiveCachesSize
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+func (s *Server) handleOrgUsageByRepository(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	usages, ok := s.orgUsage[r.PathValue("org")]
+	s.mu.Unlock()
+	if !ok {
+		writeErrorREST(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	start, end := pageBounds(r, len(usages))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_count":             len(usages),
+		"repository_cache_usages": append([]actionscache.RepoCacheUsage{}, usages[start:end]...),
+	})
+}
+
+// enterprisePolicy returns the usage policy of an enterprise, creating it
+// with the defaults of GitHub Enterprise Server. s.mu must be held.
+func (s *Server) enterprisePolicy(enterprise string) *actionscache.CacheUsagePolicy {
+	if s.enterprisePolicies == nil {
+		s.enterprisePolicies = map[string]*actionscache.CacheUsagePolicy{}
+	}
+	p, ok := s.enterprisePolicies[enterprise]
+	if !ok {
+		p = &actionscache.CacheUsagePolicy{RepoCacheSizeLimitGB: 10, MaxRepoCacheSizeLimitGB: 25}
+		s.enterprisePolicies[enterprise] = p
+	}
+	return p
+}
+
+func (s *Server) handleGetEnterprisePolicy(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	p := *s.enterprisePolicy(r.PathValue("enterprise"))
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) handleSetEnterprisePolicy(w http.ResponseWriter, r *http.Request) {
+	var p actionscache.CacheUsagePolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.RepoCacheSizeLimitGB < 0 || p.MaxRepoCacheSizeLimitGB < 0 {
+		writeErrorREST(w, http.StatusUnprocessableEntity, "Invalid request")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur := s.enterprisePolicy(r.PathValue("enterprise"))
+	// omitted fields keep their current value
+	if p.RepoCacheSizeLimitGB != 0 {
+		cur.RepoCacheSizeLimitGB = p.RepoCacheSizeLimitGB
+	}
+	if p.MaxRepoCacheSizeLimitGB != 0 {
+		cur.MaxRepoCacheSizeLimitGB = p.MaxRepoCacheSizeLimitGB
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
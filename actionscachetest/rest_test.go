@@ -0,0 +1,165 @@
+package actionscachetest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+func TestRestAPI(t *testing.T) {
+	ctx := context.TODO()
+	c, s := NewCache(t, true, actionscache.Opt{})
+
+	api, err := s.NewRestAPI("owner/repo", actionscache.Opt{})
+	require.NoError(t, err)
+
+	for _, k := range []string{"rest-a", "rest-b", "other"} {
+		err := c.Save(ctx, k, actionscache.NewBlob([]byte(k)))
+		require.NoError(t, err)
+	}
+
+	keys, err := api.ListKeys(ctx, "rest-", "")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, "rest-b", keys[0].Key)
+	require.Equal(t, "refs/heads/main", keys[0].Ref)
+	require.Equal(t, 6, keys[0].SizeInBytes)
+
+	m, err := c.AllKeys(ctx, api, "")
+	require.NoError(t, err)
+	require.Len(t, m, 3)
+
+	usage, err := api.Usage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "owner/repo", usage.FullName)
+	require.Equal(t, 3, usage.ActiveCachesCount)
+	require.Equal(t, int64(17), usage.ActiveCachesSize)
+
+	res, err := api.DeleteByKey(ctx, "rest-a", "")
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Deleted)
+	require.Equal(t, "rest-a", res.Caches[0].Key)
+
+	res, err = api.DeleteByKey(ctx, "rest-a", "")
+	require.NoError(t, err)
+	require.Equal(t, 0, res.Deleted)
+
+	res, err = api.DeleteByID(ctx, keys[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Deleted)
+
+	_, err = api.DeleteByID(ctx, keys[0].ID)
+	var he actionscache.HTTPError
+	require.True(t, errors.As(err, &he), "error was %+v", err)
+	require.Equal(t, http.StatusNotFound, he.StatusCode)
+
+	require.Equal(t, []string{"other"}, s.Keys())
+
+	// deleted key can be saved again
+	err = c.Save(ctx, "rest-a", actionscache.NewBlob([]byte("new")))
+	require.NoError(t, err)
+
+	p, err := api.UsagePolicy(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 10, p.RepoCacheSizeLimitGB)
+	require.NoError(t, api.SetUsagePolicy(ctx, 20))
+	p, err = api.UsagePolicy(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 20, p.RepoCacheSizeLimitGB)
+}
+
+func TestRestAPIOrgUsage(t *testing.T) {
+	ctx := context.TODO()
+	s := NewServer()
+	defer s.Close()
+
+	api, err := s.NewRestAPI("owner/repo", actionscache.Opt{})
+	require.NoError(t, err)
+
+	_, err = api.OrgUsage(ctx, "org")
+	var he actionscache.HTTPError
+	require.True(t, errors.As(err, &he), "error was %+v", err)
+	require.Equal(t, http.StatusNotFound, he.StatusCode)
+
+	// more than two pages of 100 repositories
+	var usages []actionscache.RepoCacheUsage
+	for i := range 250 {
+		usages = append(usages, actionscache.RepoCacheUsage{
+			FullName:          fmt.Sprintf("org/repo%d", i),
+			ActiveCachesSize:  int64(i),
+			ActiveCachesCount: 1,
+		})
+	}
+	s.SetOrgUsage("org", usages)
+
+	usage, err := api.OrgUsage(ctx, "org")
+	require.NoError(t, err)
+	require.Equal(t, 250, usage.TotalActiveCachesCount)
+	require.Equal(t, int64(250*249/2), usage.TotalActiveCachesSize)
+
+	repos, err := api.OrgUsageByRepository(ctx, "org")
+	require.NoError(t, err)
+	require.Equal(t, usages, repos)
+}
+
+func TestRestAPIEnterprisePolicy(t *testing.T) {
+	ctx := context.TODO()
+	s := NewServer()
+	defer s.Close()
+
+	api, err := s.NewRestAPI("owner/repo", actionscache.Opt{})
+	require.NoError(t, err)
+
+	p, err := api.EnterpriseUsagePolicy(ctx, "ent")
+	require.NoError(t, err)
+	require.Equal(t, actionscache.CacheUsagePolicy{RepoCacheSizeLimitGB: 10, MaxRepoCacheSizeLimitGB: 25}, *p)
+
+	require.NoError(t, api.SetEnterpriseUsagePolicy(ctx, "ent", actionscache.CacheUsagePolicy{RepoCacheSizeLimitGB: 20, MaxRepoCacheSizeLimitGB: 50}))
+	p, err = api.EnterpriseUsagePolicy(ctx, "ent")
+	require.NoError(t, err)
+	require.Equal(t, actionscache.CacheUsagePolicy{RepoCacheSizeLimitGB: 20, MaxRepoCacheSizeLimitGB: 50}, *p)
+
+	// zero fields are left unchanged
+	require.NoError(t, api.SetEnterpriseUsagePolicy(ctx, "ent", actionscache.CacheUsagePolicy{MaxRepoCacheSizeLimitGB: 40}))
+	p, err = api.EnterpriseUsagePolicy(ctx, "ent")
+	require.NoError(t, err)
+	require.Equal(t, actionscache.CacheUsagePolicy{RepoCacheSizeLimitGB: 20, MaxRepoCacheSizeLimitGB: 40}, *p)
+
+	require.NoError(t, api.SetEnterpriseUsagePolicy(ctx, "ent", actionscache.CacheUsagePolicy{RepoCacheSizeLimitGB: 5}))
+	p, err = api.EnterpriseUsagePolicy(ctx, "ent")
+	require.NoError(t, err)
+	require.Equal(t, actionscache.CacheUsagePolicy{RepoCacheSizeLimitGB: 5, MaxRepoCacheSizeLimitGB: 40}, *p)
+
+	require.NoError(t, api.SetEnterpriseUsagePolicy(ctx, "ent", actionscache.CacheUsagePolicy{}))
+	p, err = api.EnterpriseUsagePolicy(ctx, "ent")
+	require.NoError(t, err)
+	require.Equal(t, actionscache.CacheUsagePolicy{RepoCacheSizeLimitGB: 5, MaxRepoCacheSizeLimitGB: 40}, *p)
+}
+
+func TestTryEnvRestAPI(t *testing.T) {
+	ctx := context.TODO()
+	c, s := NewCache(t, false, actionscache.Opt{})
+
+	t.Setenv("GITHUB_TOKEN", "")
+	api, err := actionscache.TryEnvRestAPI(actionscache.Opt{})
+	require.NoError(t, err)
+	require.Nil(t, api)
+
+	// enterprise server style URL without /api/v3 prefix
+	t.Setenv("GITHUB_TOKEN", "token")
+	t.Setenv("GITHUB_REPOSITORY", "owner/repo")
+	t.Setenv("GITHUB_API_URL", s.URL)
+	api, err = actionscache.TryEnvRestAPI(actionscache.Opt{})
+	require.NoError(t, err)
+	require.NotNil(t, api)
+
+	require.NoError(t, c.Save(ctx, "env", actionscache.NewBlob([]byte("env"))))
+	m, err := c.AllKeys(ctx, api, "")
+	require.NoError(t, err)
+	require.Contains(t, m, "env")
+}
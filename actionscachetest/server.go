@@ -0,0 +1,302 @@
+// Package actionscachetest provides an in-process fake of the GitHub Actions
+// cache service for testing code that uses actionscache without access to a
+// real runner.
+package actionscachetest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+const twirpPrefix = "/twirp/github.actions.results.api.v1.CacheService/"
+
+// Server is a fake cache service. It serves the v1 artifactcache API, the v2
+// CacheService Twirp API and a signed-URL blob endpoint that works with both
+// plain HTTP downloads and the Azure blockblob client. The cache management
+// endpoints of the GitHub REST API are served from the same URL.
+type Server struct {
+	// URL is the base URL of the server, to be used as the cache URL.
+	URL string
+	// URLExpiry is how long signed blob URLs remain valid. Defaults to one hour.
+	URLExpiry time.Duration
+
+	srv    *httptest.Server
+	secret []byte
+
+	mu                 sync.Mutex
+	entries            []*entry
+	nextID             int
+	seq                int64
+	usagePolicy        int
+	orgUsage           map[string][]actionscache.RepoCacheUsage
+	enterprisePolicies map[string]*actionscache.CacheUsagePolicy
+}
+
+type entry struct {
+	id        int
+	key       string
+	version   string
+	scope     string
+	data      []byte
+	blocks    map[string][]byte
+	committed bool
+	seq       int64
+	createdAt time.Time
+}
+
+// NewServer starts a new fake cache service. Close needs to be called to
+// release it.
+func NewServer() *Server {
+	s := &Server{
+		URLExpiry: time.Hour,
+		secret:    make([]byte, 32),
+	}
+	if _, err := rand.Read(s.secret); err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /_apis/artifactcache/cache", s.auth(s.handleLoadV1))
+	mux.Handle("POST /_apis/artifactcache/caches", s.auth(s.handleReserveV1))
+	mux.Handle("PATCH /_apis/artifactcache/caches/{id}", s.auth(s.handleUploadV1))
+	mux.Handle("POST /_apis/artifactcache/caches/{id}", s.auth(s.handleCommitV1))
+	mux.Handle("POST "+twirpPrefix+"{method}", s.auth(s.handleTwirp))
+	mux.HandleFunc("GET /blob/{id}", s.handleBlobGet)
+	mux.HandleFunc("PUT /blob/{id}", s.handleBlobPut)
+	s.registerREST(mux)
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Token mints a runtime token for the server with the given scopes. If no
+// scopes are passed, DefaultScopes are used.
+func (s *Server) Token(scopes ...actionscache.Scope) (string, error) {
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	return NewToken(scopes, time.Hour)
+}
+
+// NewCache returns a cache client connected to the server with a token for
+// DefaultScopes.
+func (s *Server) NewCache(v2 bool, opt actionscache.Opt) (*actionscache.Cache, error) {
+	token, err := s.Token()
+	if err != nil {
+		return nil, err
+	}
+	return actionscache.New(token, s.URL, v2, opt)
+}
+
+// Keys returns the committed keys in all scopes in the order they were
+// committed.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []*entry
+	for _, e := range s.entries {
+		if e.committed {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+// NewRestAPI returns a GitHub REST API client for repo connected to the
+// server. The client uses the routes at the root of the server.
+func (s *Server) NewRestAPI(repo string, opt actionscache.Opt) (*actionscache.RestAPI, error) {
+	opt.APIURL = s.URL
+	opt.RawAPIURL = true
+	return actionscache.NewRestAPI(repo, "actionscachetest", opt)
+}
+
+// NewCache starts a Server and returns a cache client connected to it. The
+// server is closed when the test finishes.
+func NewCache(tb testing.TB, v2 bool, opt actionscache.Opt) (*actionscache.Cache, *Server) {
+	tb.Helper()
+	s := NewServer()
+	tb.Cleanup(s.Close)
+	c, err := s.NewCache(v2, opt)
+	if err != nil {
+		tb.Fatalf("failed to create cache client: %+v", err)
+	}
+	return c, s
+}
+
+type scopesKey struct{}
+
+func (s *Server) auth(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		scopes, err := parseScopes(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), scopesKey{}, scopes)))
+	})
+}
+
+func requestScopes(r *http.Request) []actionscache.Scope {
+	scopes, _ := r.Context().Value(scopesKey{}).([]actionscache.Scope)
+	return scopes
+}
+
+func writeScope(r *http.Request) (string, bool) {
+	for _, s := range requestScopes(r) {
+		if s.Permission&actionscache.PermissionWrite != 0 {
+			return s.Scope, true
+		}
+	}
+	return "", false
+}
+
+// lookup finds the entry for keys the same way the cache service does: scopes
+// are searched in token order, and for every key an exact match is preferred
+// over the newest entry that has the key as a prefix.
+func (s *Server) lookup(scopes []actionscache.Scope, keys []string, version string) *entry {
+	for _, sc := range scopes {
+		if sc.Permission&actionscache.PermissionRead == 0 {
+			continue
+		}
+		for _, k := range keys {
+			var match *entry
+			for _, e := range s.entries {
+				if !e.committed || e.scope != sc.Scope || e.version != version {
+					continue
+				}
+				if e.key == k {
+					return e
+				}
+				if strings.HasPrefix(e.key, k) && (match == nil || e.seq > match.seq) {
+					match = e
+				}
+			}
+			if match != nil {
+				return match
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) reserve(scope, key, version string) (*entry, bool) {
+	for _, e := range s.entries {
+		if e.scope == scope && e.key == key && e.version == version {
+			return nil, false
+		}
+	}
+	s.nextID++
+	e := &entry{
+		id:        s.nextID,
+		key:       key,
+		version:   version,
+		scope:     scope,
+		blocks:    map[string][]byte{},
+		createdAt: time.Now(),
+	}
+	s.entries = append(s.entries, e)
+	return e, true
+}
+
+func (s *Server) commit(e *entry) {
+	s.seq++
+	e.seq = s.seq
+	e.committed = true
+	e.blocks = nil
+}
+
+func (s *Server) entryByID(id string) *entry {
+	i, err := strconv.Atoi(id)
+	if err != nil {
+		return nil
+	}
+	for _, e := range s.entries {
+		if e.id == i {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *Server) signedURL(e *entry, perm string) string {
+	exp := time.Now().Add(s.URLExpiry).Unix()
+	return fmt.Sprintf("%s/blob/%d?sp=%s&se=%d&sig=%s", s.URL, e.id, perm, exp, s.sign(e.id, perm, exp))
+}
+
+func (s *Server) sign(id int, perm string, exp int64) string {
+	h := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(h, "%d:%s:%d", id, perm, exp)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *Server) verifySignature(r *http.Request, perm string) error {
+	q := r.URL.Query()
+	if q.Get("sp") != perm {
+		return errors.Errorf("signature does not grant %q permission", perm)
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return errors.Errorf("invalid blob id %q", r.PathValue("id"))
+	}
+	exp, err := strconv.ParseInt(q.Get("se"), 10, 64)
+	if err != nil {
+		return errors.Errorf("invalid signature expiry %q", q.Get("se"))
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(s.sign(id, perm, exp))) {
+		return errors.New("signature mismatch")
+	}
+	if time.Now().After(time.Unix(exp, 0)) {
+		return errors.New("signed URL has expired")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// SetOrgUsage sets the per repository cache usage reported for org by the
+// organization endpoints of the REST API. Organizations without usage return
+// 404.
+func (s *Server) SetOrgUsage(org string, usages []actionscache.RepoCacheUsage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.orgUsage == nil {
+		s.orgUsage = map[string][]actionscache.RepoCacheUsage{}
+	}
+	s.orgUsage[org] = append([]actionscache.RepoCacheUsage{}, usages...)
+}
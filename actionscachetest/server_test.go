@@ -0,0 +1,341 @@
+package actionscachetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+func forEachAPI(t *testing.T, f func(t *testing.T, v2 bool)) {
+	for _, v2 := range []bool{false, true} {
+		name := "v1"
+		if v2 {
+			name = "v2"
+		}
+		t.Run(name, func(t *testing.T) {
+			f(t, v2)
+		})
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, s := NewCache(t, v2, actionscache.Opt{})
+
+		ce, err := c.Load(ctx, "foo")
+		require.NoError(t, err)
+		require.Nil(t, ce)
+
+		err = c.Save(ctx, "foo-1", actionscache.NewBlob([]byte("foobar")))
+		require.NoError(t, err)
+		require.Equal(t, []string{"foo-1"}, s.Keys())
+
+		ce, err = c.Load(ctx, "foo")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+		require.Equal(t, "foo-1", ce.Key)
+
+		buf := &bytes.Buffer{}
+		err = ce.WriteTo(ctx, buf)
+		require.NoError(t, err)
+		require.Equal(t, "foobar", buf.String())
+
+		rac := ce.Download(ctx)
+		dt := make([]byte, 3)
+		n, err := rac.ReadAt(dt, 2)
+		require.NoError(t, err)
+		require.Equal(t, "oba", string(dt[:n]))
+		n, err = rac.ReadAt(dt, 4)
+		require.True(t, errors.Is(err, io.EOF))
+		require.Equal(t, "ar", string(dt[:n]))
+		require.NoError(t, rac.Close())
+	})
+}
+
+func TestExistingKey(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, _ := NewCache(t, v2, actionscache.Opt{})
+
+		err := c.Save(ctx, "key1", actionscache.NewBlob([]byte("foo1")))
+		require.NoError(t, err)
+
+		err = c.Save(ctx, "key1", actionscache.NewBlob([]byte("foo2")))
+		require.Error(t, err)
+		require.True(t, errors.Is(err, os.ErrExist), "error was %+v", err)
+		var he actionscache.HTTPError
+		require.True(t, errors.As(err, &he), "error was %+v", err)
+		require.Equal(t, http.StatusConflict, he.StatusCode)
+	})
+}
+
+func TestChunkedSave(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, _ := NewCache(t, v2, actionscache.Opt{UploadChunkSize: 3})
+
+		err := c.Save(ctx, "chunked", actionscache.NewBlob([]byte("0123456789")))
+		require.NoError(t, err)
+
+		ce, err := c.Load(ctx, "chunked")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+
+		buf := &bytes.Buffer{}
+		err = ce.WriteTo(ctx, buf)
+		require.NoError(t, err)
+		require.Equal(t, "0123456789", buf.String())
+	})
+}
+
+func TestPartialKeyOrder(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, _ := NewCache(t, v2, actionscache.Opt{})
+
+		for _, k := range []string{"foo22", "fo", "foo1"} {
+			err := c.Save(ctx, "partial-"+k, actionscache.NewBlob([]byte(k)))
+			require.NoError(t, err)
+		}
+
+		for prefix, exp := range map[string]string{
+			"foo":  "foo1",
+			"":     "foo1",
+			"foo2": "foo22",
+			"fo":   "fo",
+		} {
+			ce, err := c.Load(ctx, "partial-"+prefix)
+			require.NoError(t, err)
+			require.NotNil(t, ce)
+			require.Equal(t, "partial-"+exp, ce.Key)
+		}
+
+		ce, err := c.Load(ctx, "partial-foo3")
+		require.NoError(t, err)
+		require.Nil(t, ce)
+
+		ce, err = c.Load(ctx, "partial-foo3", "partial-foo2")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+		require.Equal(t, "partial-foo22", ce.Key)
+	})
+}
+
+func TestScopes(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		s := NewServer()
+		defer s.Close()
+
+		main, err := s.NewCache(v2, actionscache.Opt{})
+		require.NoError(t, err)
+		err = main.Save(ctx, "scoped", actionscache.NewBlob([]byte("main")))
+		require.NoError(t, err)
+
+		token, err := s.Token(
+			actionscache.Scope{Scope: "refs/pull/1/merge", Permission: actionscache.PermissionRead | actionscache.PermissionWrite},
+			actionscache.Scope{Scope: "refs/heads/main", Permission: actionscache.PermissionRead},
+		)
+		require.NoError(t, err)
+		pr, err := actionscache.New(token, s.URL, v2, actionscache.Opt{})
+		require.NoError(t, err)
+
+		ce, err := pr.Load(ctx, "scoped")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+		if !v2 {
+			// v2 API does not report the scope of the matched entry
+			require.Equal(t, "refs/heads/main", ce.Scope)
+		}
+
+		// same key can be written again in the writable scope and takes precedence
+		err = pr.Save(ctx, "scoped", actionscache.NewBlob([]byte("pr")))
+		require.NoError(t, err)
+
+		ce, err = pr.Load(ctx, "scoped")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+		buf := &bytes.Buffer{}
+		require.NoError(t, ce.WriteTo(ctx, buf))
+		require.Equal(t, "pr", buf.String())
+	})
+}
+
+func TestMutable(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, _ := NewCache(t, v2, actionscache.Opt{})
+
+		for i, s := range []string{"abc", "def", "ghi"} {
+			err := c.SaveMutable(ctx, "mutable", 10*time.Second, func(ce *actionscache.Entry) (actionscache.Blob, error) {
+				buf := &bytes.Buffer{}
+				if i == 0 {
+					require.Nil(t, ce)
+				} else {
+					require.NotNil(t, ce)
+					require.Equal(t, fmt.Sprintf("mutable#%d", i), ce.Key)
+					require.NoError(t, ce.WriteTo(ctx, buf))
+				}
+				buf.WriteString(s)
+				return actionscache.NewBlob(buf.Bytes()), nil
+			})
+			require.NoError(t, err)
+		}
+
+		ce, err := c.Load(ctx, "mutable")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+		require.Equal(t, "mutable#3", ce.Key)
+		buf := &bytes.Buffer{}
+		require.NoError(t, ce.WriteTo(ctx, buf))
+		require.Equal(t, "abcdefghi", buf.String())
+	})
+}
+
+func TestExpiredToken(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	token, err := NewTokenWithTimes(nil, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	_, err = actionscache.New(token, s.URL, false, actionscache.Opt{})
+	require.ErrorContains(t, err, "expired")
+}
+
+type writerAt []byte
+
+func (w writerAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(w[off:], p), nil
+}
+
+func TestDownloadTo(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, _ := NewCache(t, v2, actionscache.Opt{})
+
+		data := bytes.Repeat([]byte("0123456789"), 100)
+		err := c.Save(ctx, "large", actionscache.NewBlob(data))
+		require.NoError(t, err)
+		err = c.Save(ctx, "empty", actionscache.NewBlob(nil))
+		require.NoError(t, err)
+
+		ce, err := c.Load(ctx, "large")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+
+		size, err := ce.Size(ctx)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), size)
+
+		buf := make(writerAt, len(data))
+		err = ce.DownloadTo(ctx, buf, actionscache.DownloadOpt{Concurrency: 3, ChunkSize: 64})
+		require.NoError(t, err)
+		require.Equal(t, data, []byte(buf))
+
+		ce, err = c.Load(ctx, "empty")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+
+		size, err = ce.Size(ctx)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), size)
+		require.NoError(t, ce.DownloadTo(ctx, writerAt{}, actionscache.DownloadOpt{}))
+	})
+}
+
+func TestReloadExpiredURL(t *testing.T) {
+	ctx := context.TODO()
+	c, s := NewCache(t, true, actionscache.Opt{})
+	require.NoError(t, c.Save(ctx, "foo-1", actionscache.NewBlob([]byte("foo1"))))
+
+	s.mu.Lock()
+	s.URLExpiry = -time.Hour
+	s.mu.Unlock()
+	ce, err := c.Load(ctx, "foo-")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	s.mu.Lock()
+	s.URLExpiry = time.Hour
+	s.mu.Unlock()
+
+	// a newer entry matching the same prefix is not picked up on reload
+	require.NoError(t, c.Save(ctx, "foo-2", actionscache.NewBlob([]byte("foo2"))))
+	buf := &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	require.Equal(t, "foo1", buf.String())
+	require.Equal(t, "foo-1", ce.Key)
+}
+
+func TestReloadDeletedEntry(t *testing.T) {
+	ctx := context.TODO()
+	s := NewServer()
+	defer s.Close()
+
+	main, err := s.NewCache(true, actionscache.Opt{})
+	require.NoError(t, err)
+	token, err := s.Token(
+		actionscache.Scope{Scope: "refs/pull/1/merge", Permission: actionscache.PermissionRead | actionscache.PermissionWrite},
+		actionscache.Scope{Scope: "refs/heads/main", Permission: actionscache.PermissionRead},
+	)
+	require.NoError(t, err)
+	pr, err := actionscache.New(token, s.URL, true, actionscache.Opt{})
+	require.NoError(t, err)
+	api, err := s.NewRestAPI("owner/repo", actionscache.Opt{})
+	require.NoError(t, err)
+
+	// load an entry with an expired URL and delete it before it is read
+	load := func(c *actionscache.Cache, key string) *actionscache.Entry {
+		s.mu.Lock()
+		s.URLExpiry = -time.Hour
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.URLExpiry = time.Hour
+			s.mu.Unlock()
+		}()
+		ce, err := c.Load(ctx, key)
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+		return ce
+	}
+	// delete the newest entry with key in ref
+	deleteNewest := func(key, ref string) {
+		keys, err := api.ListKeys(ctx, key, ref)
+		require.NoError(t, err)
+		require.NotEmpty(t, keys)
+		_, err = api.DeleteByID(ctx, keys[0].ID)
+		require.NoError(t, err)
+	}
+
+	// the same key in another scope is not picked up on reload
+	require.NoError(t, main.Save(ctx, "scoped", actionscache.NewBlob([]byte("main"))))
+	require.NoError(t, pr.Save(ctx, "scoped", actionscache.NewBlob([]byte("pr"))))
+	ce := load(pr, "scoped")
+	deleteNewest("scoped", "refs/pull/1/merge")
+	err = ce.WriteTo(ctx, &bytes.Buffer{})
+	require.ErrorContains(t, err, "no longer exists")
+
+	// the same key of another version is not picked up on reload
+	cv := main.WithVersion("v1")
+	require.NoError(t, main.Save(ctx, "versioned", actionscache.NewBlob([]byte("default"))))
+	require.NoError(t, cv.Save(ctx, "versioned", actionscache.NewBlob([]byte("v1"))))
+	ce = load(cv, "versioned")
+	deleteNewest("versioned", "")
+	err = ce.WriteTo(ctx, &bytes.Buffer{})
+	require.ErrorContains(t, err, "no longer exists")
+
+	buf := &bytes.Buffer{}
+	ce = load(main, "versioned")
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	require.Equal(t, "default", buf.String())
+}
@@ -0,0 +1,70 @@
+package actionscachetest
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// signingKey is used for all minted tokens. Tokens are never verified by the
+// client or the fake server, the signature only needs to be well-formed.
+var signingKey = []byte("actionscachetest")
+
+// DefaultScopes are used when a token is minted without explicit scopes. It
+// matches what a push build on the main branch gets.
+var DefaultScopes = []actionscache.Scope{
+	{Scope: "refs/heads/main", Permission: actionscache.PermissionRead | actionscache.PermissionWrite},
+}
+
+// NewToken mints a runtime token with the "ac", "nbf" and "exp" claims that
+// actionscache.New expects. The token is valid from now until ttl has passed.
+func NewToken(scopes []actionscache.Scope, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return NewTokenWithTimes(scopes, now.Add(-time.Minute), now.Add(ttl))
+}
+
+// NewTokenWithTimes mints a runtime token with explicit not-before and
+// expiration times, for testing token validation.
+func NewTokenWithTimes(scopes []actionscache.Scope, nbf, exp time.Time) (string, error) {
+	if scopes == nil {
+		scopes = DefaultScopes
+	}
+	ac, err := json.Marshal(scopes)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	tk := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"ac":  string(ac),
+		"iss": "actionscachetest",
+		"nbf": nbf.Unix(),
+		"exp": exp.Unix(),
+	})
+	s, err := tk.SignedString(signingKey)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return s, nil
+}
+
+func parseScopes(token string) ([]actionscache.Scope, error) {
+	tk, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	claims, ok := tk.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.Errorf("invalid token without claims map")
+	}
+	acs, ok := claims["ac"].(string)
+	if !ok {
+		return nil, errors.Errorf("invalid token without access controls")
+	}
+	var scopes []actionscache.Scope
+	if err := json.Unmarshal([]byte(acs), &scopes); err != nil {
+		return nil, errors.Wrap(err, "failed to parse token access controls")
+	}
+	return scopes, nil
+}
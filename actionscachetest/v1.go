@@ -0,0 +1,138 @@
+package actionscachetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+func writeErrorV1(w http.ResponseWriter, status int, typeKey, msg string) {
+	writeJSON(w, status, actionscache.GithubAPIError{
+		Message:  msg,
+		TypeName: "Microsoft.Azure.DevOps.ArtifactCache.WebApi." + typeKey,
+		TypeKey:  typeKey,
+	})
+}
+
+func (s *Server) handleLoadV1(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	keys := strings.Split(q.Get("keys"), ",")
+	version := q.Get("version")
+	if len(keys) == 0 || keys[0] == "" || version == "" {
+		writeErrorV1(w, http.StatusBadRequest, "ArgumentException", "keys and version are required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.lookup(requestScopes(r), keys, version)
+	if e == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"cacheKey":        e.key,
+		"scope":           e.scope,
+		"cacheVersion":    e.version,
+		"archiveLocation": s.signedURL(e, "r"),
+	})
+}
+
+func (s *Server) handleReserveV1(w http.ResponseWriter, r *http.Request) {
+	var req actionscache.ReserveCacheReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorV1(w, http.StatusBadRequest, "ArgumentException", err.Error())
+		return
+	}
+	if req.Key == "" || req.Version == "" {
+		writeErrorV1(w, http.StatusBadRequest, "ArgumentException", "key and version are required")
+		return
+	}
+	scope, ok := writeScope(r)
+	if !ok {
+		writeErrorV1(w, http.StatusForbidden, "ArtifactCacheAccessDeniedException", "token has no write access")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.reserve(scope, req.Key, req.Version)
+	if !ok {
+		writeErrorV1(w, http.StatusConflict, "ArtifactCacheItemAlreadyExistsException", fmt.Sprintf("Cache already exists. Scope: %s, Key: %s, Version: %s", scope, req.Key, req.Version))
+		return
+	}
+	writeJSON(w, http.StatusCreated, actionscache.ReserveCacheResp{CacheID: e.id})
+}
+
+func (s *Server) handleUploadV1(w http.ResponseWriter, r *http.Request) {
+	var start, end int64
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/*", &start, &end); err != nil || start < 0 || end < start {
+		writeErrorV1(w, http.StatusBadRequest, "ArgumentException", fmt.Sprintf("invalid content range %q", r.Header.Get("Content-Range")))
+		return
+	}
+	dt, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeErrorV1(w, http.StatusBadRequest, "ArgumentException", err.Error())
+		return
+	}
+	if int64(len(dt)) != end-start+1 {
+		writeErrorV1(w, http.StatusBadRequest, "ArgumentException", fmt.Sprintf("content range %d-%d does not match body size %d", start, end, len(dt)))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entryByID(r.PathValue("id"))
+	if e == nil || !s.canWrite(r, e) {
+		writeErrorV1(w, http.StatusNotFound, "ArtifactCacheItemNotFoundException", "cache not found")
+		return
+	}
+	if e.committed {
+		writeErrorV1(w, http.StatusBadRequest, "ArtifactCacheItemAlreadyCommittedException", "cache already committed")
+		return
+	}
+	if need := end + 1; int64(len(e.data)) < need {
+		e.data = append(e.data, make([]byte, need-int64(len(e.data)))...)
+	}
+	copy(e.data[start:], dt)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleCommitV1(w http.ResponseWriter, r *http.Request) {
+	var req actionscache.CommitCacheReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorV1(w, http.StatusBadRequest, "ArgumentException", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entryByID(r.PathValue("id"))
+	if e == nil || !s.canWrite(r, e) {
+		writeErrorV1(w, http.StatusNotFound, "ArtifactCacheItemNotFoundException", "cache not found")
+		return
+	}
+	if e.committed {
+		writeErrorV1(w, http.StatusBadRequest, "ArtifactCacheItemAlreadyCommittedException", "cache already committed")
+		return
+	}
+	if int64(len(e.data)) != req.Size {
+		writeErrorV1(w, http.StatusBadRequest, "ArtifactCacheSizeMismatchException", fmt.Sprintf("uploaded size %d does not match expected size %d", len(e.data), req.Size))
+		return
+	}
+	s.commit(e)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) canWrite(r *http.Request, e *entry) bool {
+	scope, ok := writeScope(r)
+	return ok && scope == e.scope
+}
@@ -0,0 +1,153 @@
+package actionscachetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+var twirpStatus = map[string]int{
+	"invalid_argument":  http.StatusBadRequest,
+	"malformed":         http.StatusBadRequest,
+	"bad_route":         http.StatusNotFound,
+	"unauthenticated":   http.StatusUnauthorized,
+	"permission_denied": http.StatusForbidden,
+	"not_found":         http.StatusNotFound,
+	"already_exists":    http.StatusConflict,
+	"internal":          http.StatusInternalServerError,
+}
+
+func writeErrorV2(w http.ResponseWriter, code, msg string) {
+	status, ok := twirpStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, map[string]string{
+		"code": code,
+		"msg":  msg,
+	})
+}
+
+func (s *Server) handleTwirp(w http.ResponseWriter, r *http.Request) {
+	switch m := r.PathValue("method"); m {
+	case "CreateCacheEntry":
+		s.handleReserveV2(w, r)
+	case "FinalizeCacheEntryUpload":
+		s.handleCommitV2(w, r)
+	case "GetCacheEntryDownloadURL":
+		s.handleLoadV2(w, r)
+	default:
+		writeErrorV2(w, "bad_route", fmt.Sprintf("no handler for method %s", m))
+	}
+}
+
+func (s *Server) handleReserveV2(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key     string `json:"key"`
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorV2(w, "malformed", err.Error())
+		return
+	}
+	if req.Key == "" || req.Version == "" {
+		writeErrorV2(w, "invalid_argument", "key and version are required")
+		return
+	}
+	scope, ok := writeScope(r)
+	if !ok {
+		writeErrorV2(w, "permission_denied", "token has no write access")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.reserve(scope, req.Key, req.Version)
+	if !ok {
+		writeErrorV2(w, "already_exists", "cache entry with the same key, version, and scope already exists")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":                true,
+		"signed_upload_url": s.signedURL(e, "w"),
+	})
+}
+
+func (s *Server) handleCommitV2(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key       string `json:"key"`
+		SizeBytes int64  `json:"size_bytes"`
+		Version   string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorV2(w, "malformed", err.Error())
+		return
+	}
+	scope, ok := writeScope(r)
+	if !ok {
+		writeErrorV2(w, "permission_denied", "token has no write access")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var e *entry
+	for _, e2 := range s.entries {
+		if e2.scope == scope && e2.key == req.Key && e2.version == req.Version {
+			e = e2
+			break
+		}
+	}
+	if e == nil {
+		writeErrorV2(w, "not_found", "cache entry not found")
+		return
+	}
+	if e.committed {
+		writeErrorV2(w, "already_exists", "cache entry already finalized")
+		return
+	}
+	if int64(len(e.data)) != req.SizeBytes {
+		writeErrorV2(w, "invalid_argument", fmt.Sprintf("uploaded size %d does not match expected size %d", len(e.data), req.SizeBytes))
+		return
+	}
+	s.commit(e)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":       true,
+		"entry_id": strconv.Itoa(e.id),
+	})
+}
+
+func (s *Server) handleLoadV2(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key         string   `json:"key"`
+		RestoreKeys []string `json:"restore_keys"`
+		Version     string   `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorV2(w, "malformed", err.Error())
+		return
+	}
+	if req.Key == "" || req.Version == "" {
+		writeErrorV2(w, "invalid_argument", "key and version are required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.lookup(requestScopes(r), append([]string{req.Key}, req.RestoreKeys...), req.Version)
+	if e == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ok": false,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":                  true,
+		"signed_download_url": s.signedURL(e, "r"),
+		"matched_key":         e.key,
+	})
+}
@@ -56,3 +56,83 @@ func TestAllKeys(t *testing.T) {
 	_, ok = m[k]
 	require.True(t, ok)
 }
+
+func TestDeleteByKey(t *testing.T) {
+	ctx := context.TODO()
+
+	ghToken, ok := os.LookupEnv("GITHUB_TOKEN")
+	if !ok || ghToken == "" {
+		t.Log("GITHUB_TOKEN not set")
+		t.SkipNow()
+	}
+	ghRepo, ok := os.LookupEnv("GITHUB_REPOSITORY")
+	if !ok || ghRepo == "" {
+		t.Log("GITHUB_REPOSITORY not set")
+		t.SkipNow()
+	}
+
+	c, err := TryEnv(Opt{})
+	require.NoError(t, err)
+	if c == nil {
+		t.SkipNow()
+	}
+
+	if !c.IsV2 {
+		t.Skip("rest API is only enabled for v2 in this repo")
+	}
+
+	api, err := NewRestAPI(ghRepo, ghToken, Opt{})
+	require.NoError(t, err)
+
+	k := "delete_test_" + newID()
+
+	res, err := api.DeleteByKey(ctx, k, "")
+	require.NoError(t, err)
+	require.Equal(t, 0, res.Deleted)
+
+	err = c.Save(ctx, k, NewBlob([]byte("foobar")))
+	require.NoError(t, err)
+
+	// v2 API is not immediately consistent
+	time.Sleep(2 * time.Second)
+
+	m, err := c.AllKeys(ctx, api, k)
+	require.NoError(t, err)
+	_, ok = m[k]
+	require.True(t, ok)
+
+	res, err = api.DeleteByKey(ctx, k, "")
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Deleted)
+	require.Equal(t, k, res.Caches[0].Key)
+
+	time.Sleep(2 * time.Second)
+
+	m, err = c.AllKeys(ctx, api, k)
+	require.NoError(t, err)
+	_, ok = m[k]
+	require.False(t, ok)
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.TODO()
+
+	ghToken, ok := os.LookupEnv("GITHUB_TOKEN")
+	if !ok || ghToken == "" {
+		t.Log("GITHUB_TOKEN not set")
+		t.SkipNow()
+	}
+	ghRepo, ok := os.LookupEnv("GITHUB_REPOSITORY")
+	if !ok || ghRepo == "" {
+		t.Log("GITHUB_REPOSITORY not set")
+		t.SkipNow()
+	}
+
+	api, err := NewRestAPI(ghRepo, ghToken, Opt{})
+	require.NoError(t, err)
+
+	usage, err := api.Usage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ghRepo, usage.FullName)
+	require.GreaterOrEqual(t, usage.ActiveCachesSize, int64(0))
+}
@@ -0,0 +1,402 @@
+// Package archive saves and restores directories in the same format as the
+// actions/cache action, so caches can be shared with actions/cache steps in
+// the same workflow.
+//
+// Archives are tar files of the saved paths compressed with zstd, or gzip if
+// requested. Paths are stored relative to the workspace directory, so paths
+// outside of it, for example under the home directory, are stored with
+// leading "../" components.
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+	"golang.org/x/sync/errgroup"
+)
+
+// Opt configures SaveDirs and RestoreDirs.
+type Opt struct {
+	// Compression is the compression method used for saving. Defaults to
+	// zstd. Restoring detects the compression of the archive.
+	Compression actionscache.ToolkitCompression
+	// CrossOS makes caches saved on Windows visible on other platforms and
+	// the other way around.
+	CrossOS bool
+	// Workspace is the directory paths are relative to when saving. Defaults
+	// to $GITHUB_WORKSPACE or the current directory.
+	Workspace string
+	// Paths are the paths the cache was saved with. If set, RestoreDirs uses
+	// them to compute the cache version, otherwise the version of the Cache
+	// is used.
+	Paths []string
+}
+
+// zstdDecoderMaxWindow is the window of archives compressed by actions/cache
+// with --long=30
+const zstdDecoderMaxWindow = 1 << 30
+
+func workspace(opt Opt) (string, error) {
+	if opt.Workspace != "" {
+		return filepath.Abs(opt.Workspace)
+	}
+	if v, ok := os.LookupEnv("GITHUB_WORKSPACE"); ok && v != "" {
+		return v, nil
+	}
+	wd, err := os.Getwd()
+	return wd, errors.WithStack(err)
+}
+
+func compression(opt Opt) actionscache.ToolkitCompression {
+	if opt.Compression == "" {
+		return actionscache.ToolkitZstd
+	}
+	return opt.Compression
+}
+
+// SaveDirs saves the paths under key. Paths may start with ~ for the home
+// directory, contain glob patterns and exclude matches with a leading !, like
+// the path input of actions/cache.
+func SaveDirs(ctx context.Context, c *actionscache.Cache, key string, paths []string, opts ...Opt) error {
+	var opt Opt
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	ws, err := workspace(opt)
+	if err != nil {
+		return err
+	}
+	method := compression(opt)
+	files, excludes, err := resolvePaths(ws, paths)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.Errorf("no files found for paths %v", paths)
+	}
+
+	b, err := actionscache.CreateTempBlob("", "actionscache-archive-")
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	if err := writeArchive(b, ws, files, excludes, method); err != nil {
+		return err
+	}
+	if err := b.UpdateSize(); err != nil {
+		return err
+	}
+
+	// actions/cache can only read the archive if it is saved as is
+	cv := c.Plain().WithVersion(actionscache.ToolkitVersion(paths, method, opt.CrossOS))
+	return cv.Save(ctx, key, b)
+}
+
+// RestoreDirs restores the first entry matching keys into dest, which is the
+// workspace directory of the saved paths. The matched key is returned, or an
+// empty string if no entry was found.
+func RestoreDirs(ctx context.Context, c *actionscache.Cache, keys []string, dest string, opts ...Opt) (string, error) {
+	var opt Opt
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	caches := []*actionscache.Cache{c}
+	if len(opt.Paths) > 0 {
+		caches = nil
+		methods := []actionscache.ToolkitCompression{compression(opt)}
+		if methods[0] != actionscache.ToolkitGzip {
+			// caches saved where zstd was not available
+			methods = append(methods, actionscache.ToolkitGzip)
+		}
+		for _, m := range methods {
+			caches = append(caches, c.WithVersion(actionscache.ToolkitVersion(opt.Paths, m, opt.CrossOS)))
+		}
+	}
+
+	for _, c := range caches {
+		ce, err := c.Load(ctx, keys...)
+		if err != nil {
+			return "", err
+		}
+		if ce == nil {
+			continue
+		}
+		pr, pw := io.Pipe()
+		var eg errgroup.Group
+		eg.Go(func() error {
+			err := ce.WriteTo(ctx, pw)
+			pw.CloseWithError(err)
+			return err
+		})
+		err = extractArchive(pr, dest)
+		if err == nil {
+			// the end of the tar stream is not the end of the entry, WriteTo
+			// can still fail, for example when verifying the digest
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		if err2 := eg.Wait(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to restore %s", ce.Key)
+		}
+		return ce.Key, nil
+	}
+	return "", nil
+}
+
+// resolvePaths expands the path patterns to existing files and directories.
+// Patterns for excluded files are returned separately.
+func resolvePaths(ws string, patterns []string) ([]string, []string, error) {
+	home, _ := os.UserHomeDir()
+	expand := func(p string) string {
+		if p == "~" || strings.HasPrefix(p, "~/") {
+			p = filepath.Join(home, p[1:])
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(ws, p)
+		}
+		return filepath.Clean(p)
+	}
+
+	var includes, excludes []string
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		if ex, ok := strings.CutPrefix(p, "!"); ok {
+			excludes = append(excludes, expand(ex))
+		} else {
+			includes = append(includes, expand(p))
+		}
+	}
+
+	seen := map[string]struct{}{}
+	var out []string
+	for _, p := range includes {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid path %s", p)
+		}
+		for _, m := range matches {
+			if _, ok := seen[m]; !ok && !excluded(excludes, m) {
+				seen[m] = struct{}{}
+				out = append(out, m)
+			}
+		}
+	}
+	return out, excludes, nil
+}
+
+func excluded(excludes []string, p string) bool {
+	for _, ex := range excludes {
+		if ok, _ := filepath.Match(ex, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveName returns the name of a file in the archive, relative to the
+// workspace with forward slashes
+func archiveName(ws, p string) (string, error) {
+	rel, err := filepath.Rel(ws, p)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "" {
+		rel = "."
+	}
+	return rel, nil
+}
+
+func writeArchive(w io.Writer, ws string, files, excludes []string, method actionscache.ToolkitCompression) error {
+	bw := bufio.NewWriter(w)
+	var cw io.WriteCloser
+	switch method {
+	case actionscache.ToolkitZstd, actionscache.ToolkitZstdWithoutLong:
+		// the default window can be decoded with and without --long
+		zw, err := zstd.NewWriter(bw)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		cw = zw
+	case actionscache.ToolkitGzip:
+		cw = gzip.NewWriter(bw)
+	default:
+		return errors.Errorf("unsupported compression %q", method)
+	}
+
+	tw := tar.NewWriter(cw)
+	for _, f := range files {
+		err := filepath.Walk(f, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if excluded(excludes, p) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			name, err := archiveName(ws, p)
+			if err != nil {
+				return err
+			}
+			return addFile(tw, p, name, fi)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to archive %s", f)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := cw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(bw.Flush())
+}
+
+func addFile(tw *tar.Writer, p, name string, fi os.FileInfo) error {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		l, err := os.Readlink(p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		link = l
+	} else if !fi.Mode().IsRegular() && !fi.IsDir() {
+		return nil // sockets, devices etc. are skipped
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	hdr.Name = name
+	if fi.IsDir() && !strings.HasSuffix(hdr.Name, "/") {
+		hdr.Name += "/"
+	}
+	// same as tar --posix
+	hdr.Format = tar.FormatPAX
+	hdr.Uname, hdr.Gname = "", ""
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.WithStack(err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return errors.WithStack(err)
+}
+
+// decompress detects the compression of the archive from its magic bytes
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read archive header")
+	}
+	switch {
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderMaxWindow(zstdDecoderMaxWindow))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return zr.IOReadCloser(), nil
+	case bytes.Equal(magic[:2], []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		return gr, errors.WithStack(err)
+	default:
+		return nil, errors.Errorf("unknown archive compression")
+	}
+}
+
+func extractArchive(r io.Reader, dest string) error {
+	dr, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// like tar -P, names may point outside of dest
+		target := filepath.FromSlash(hdr.Name)
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dest, target)
+		}
+		if err := extractFile(tr, hdr, target, dest); err != nil {
+			return errors.Wrapf(err, "failed to extract %s", hdr.Name)
+		}
+	}
+}
+
+func extractFile(tr *tar.Reader, hdr *tar.Header, target, dest string) error {
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, mode.Perm()|0700); err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		os.Remove(target)
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return errors.WithStack(err)
+		}
+		if err := f.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		os.Remove(target)
+		return errors.WithStack(os.Symlink(hdr.Linkname, target))
+	case tar.TypeLink:
+		link := filepath.FromSlash(hdr.Linkname)
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(dest, link)
+		}
+		os.Remove(target)
+		return errors.WithStack(os.Link(link, target))
+	default:
+		return nil
+	}
+	return errors.WithStack(os.Chtimes(target, hdr.ModTime, hdr.ModTime))
+}
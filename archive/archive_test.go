@@ -0,0 +1,255 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+	"github.com/tonistiigi/go-actions-cache/actionscachetest"
+)
+
+// setup creates a workspace and a home directory under a new temporary
+// directory
+func setup(t *testing.T) (ws, home string) {
+	root := t.TempDir()
+	ws = filepath.Join(root, "ws")
+	home = filepath.Join(root, "home")
+	require.NoError(t, os.MkdirAll(ws, 0755))
+	require.NoError(t, os.MkdirAll(home, 0755))
+	t.Setenv("HOME", home)
+	return ws, home
+}
+
+func writeFile(t *testing.T, p, dt string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+	require.NoError(t, os.WriteFile(p, []byte(dt), 0644))
+}
+
+func readFile(t *testing.T, p string) string {
+	dt, err := os.ReadFile(p)
+	require.NoError(t, err)
+	return string(dt)
+}
+
+func archiveNames(t *testing.T, c *actionscache.Cache, key string) []string {
+	ctx := context.TODO()
+	ce, err := c.Load(ctx, key)
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	buf := &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	dr, err := decompress(buf)
+	require.NoError(t, err)
+	defer dr.Close()
+
+	var names []string
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSaveRestore(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		name := "v1"
+		if v2 {
+			name = "v2"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+			c, _ := actionscachetest.NewCache(t, v2, actionscache.Opt{})
+
+			ws, home := setup(t)
+			writeFile(t, filepath.Join(ws, "src", "a.txt"), "a")
+			writeFile(t, filepath.Join(ws, "src", "sub", "b.txt"), "b")
+			writeFile(t, filepath.Join(ws, "src", "skip.log"), "skip")
+			require.NoError(t, os.Symlink("a.txt", filepath.Join(ws, "src", "link")))
+			writeFile(t, filepath.Join(home, ".cache", "tool", "c.txt"), "c")
+
+			paths := []string{"src", "~/.cache/tool", "!src/*.log"}
+			err := SaveDirs(ctx, c, "deps-1", paths, Opt{Workspace: ws})
+			require.NoError(t, err)
+
+			cv := c.WithVersion(actionscache.ToolkitVersion(paths, actionscache.ToolkitZstd, false))
+			require.Equal(t, []string{
+				"../home/.cache/tool/",
+				"../home/.cache/tool/c.txt",
+				"src/",
+				"src/a.txt",
+				"src/link",
+				"src/sub/",
+				"src/sub/b.txt",
+			}, archiveNames(t, cv, "deps-1"))
+
+			// entries are not visible with the default version
+			key, err := RestoreDirs(ctx, c, []string{"deps-"}, t.TempDir())
+			require.NoError(t, err)
+			require.Equal(t, "", key)
+
+			ws2, home2 := setup(t)
+			key, err = RestoreDirs(ctx, c, []string{"deps-"}, ws2, Opt{Paths: paths})
+			require.NoError(t, err)
+			require.Equal(t, "deps-1", key)
+
+			require.Equal(t, "a", readFile(t, filepath.Join(ws2, "src", "a.txt")))
+			require.Equal(t, "b", readFile(t, filepath.Join(ws2, "src", "sub", "b.txt")))
+			require.Equal(t, "c", readFile(t, filepath.Join(home2, ".cache", "tool", "c.txt")))
+			link, err := os.Readlink(filepath.Join(ws2, "src", "link"))
+			require.NoError(t, err)
+			require.Equal(t, "a.txt", link)
+			_, err = os.Stat(filepath.Join(ws2, "src", "skip.log"))
+			require.ErrorIs(t, err, os.ErrNotExist)
+
+			fi1, err := os.Stat(filepath.Join(ws, "src", "a.txt"))
+			require.NoError(t, err)
+			fi2, err := os.Stat(filepath.Join(ws2, "src", "a.txt"))
+			require.NoError(t, err)
+			require.True(t, fi1.ModTime().Truncate(1e9).Equal(fi2.ModTime().Truncate(1e9)))
+
+			key, err = RestoreDirs(ctx, c, []string{"other-"}, ws2, Opt{Paths: paths})
+			require.NoError(t, err)
+			require.Equal(t, "", key)
+		})
+	}
+}
+
+func TestRestoreGzipFallback(t *testing.T) {
+	ctx := context.TODO()
+	c, _ := actionscachetest.NewCache(t, true, actionscache.Opt{})
+
+	ws, _ := setup(t)
+	writeFile(t, filepath.Join(ws, "out", "a.txt"), "gzipped")
+
+	paths := []string{"out"}
+	err := SaveDirs(ctx, c, "build-1", paths, Opt{Workspace: ws, Compression: actionscache.ToolkitGzip})
+	require.NoError(t, err)
+
+	// saved version only matches gzip
+	ce, err := c.WithVersion(actionscache.ToolkitVersion(paths, actionscache.ToolkitZstd, false)).Load(ctx, "build-1")
+	require.NoError(t, err)
+	require.Nil(t, ce)
+
+	dest := t.TempDir()
+	key, err := RestoreDirs(ctx, c, []string{"build-1"}, dest, Opt{Paths: paths})
+	require.NoError(t, err)
+	require.Equal(t, "build-1", key)
+	require.Equal(t, "gzipped", readFile(t, filepath.Join(dest, "out", "a.txt")))
+
+	// restoring with a Cache that already has the version
+	dest = t.TempDir()
+	cv := c.WithVersion(actionscache.ToolkitVersion(paths, actionscache.ToolkitGzip, false))
+	key, err = RestoreDirs(ctx, cv, []string{"build-"}, dest)
+	require.NoError(t, err)
+	require.Equal(t, "build-1", key)
+	require.Equal(t, "gzipped", readFile(t, filepath.Join(dest, "out", "a.txt")))
+}
+
+// brokenBackend returns a single entry whose data fails with errBroken after
+// the archive has been read
+type brokenBackend struct {
+	data []byte
+}
+
+var errBroken = errors.New("connection reset")
+
+func (b *brokenBackend) Lookup(ctx context.Context, keys ...string) (*actionscache.Entry, error) {
+	return actionscache.NewEntry("broken", "", b), nil
+}
+
+func (b *brokenBackend) Reserve(ctx context.Context, key string) (*actionscache.Reservation, error) {
+	return nil, errors.New("read-only")
+}
+
+func (b *brokenBackend) Upload(ctx context.Context, r *actionscache.Reservation, blob actionscache.Blob) error {
+	return errors.New("read-only")
+}
+
+func (b *brokenBackend) Commit(ctx context.Context, r *actionscache.Reservation, size int64) error {
+	return errors.New("read-only")
+}
+
+func (b *brokenBackend) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	r := bytes.NewReader(b.data[offset:])
+	if length >= 0 {
+		return io.NopCloser(io.LimitReader(r, length)), nil
+	}
+	return io.NopCloser(io.MultiReader(r, iotest.ErrReader(errBroken))), nil
+}
+
+func (b *brokenBackend) Size(ctx context.Context) (int64, error) {
+	return int64(len(b.data)), nil
+}
+
+func TestRestoreReadError(t *testing.T) {
+	ctx := context.TODO()
+	c, _ := actionscachetest.NewCache(t, false, actionscache.Opt{})
+
+	ws, _ := setup(t)
+	// larger than the header read when loading the entry
+	dt := make([]byte, 256*1024)
+	_, err := rand.Read(dt)
+	require.NoError(t, err)
+	writeFile(t, filepath.Join(ws, "out", "a.bin"), string(dt))
+	require.NoError(t, SaveDirs(ctx, c, "broken", []string{"out"}, Opt{Workspace: ws}))
+	ce, err := c.WithVersion(actionscache.ToolkitVersion([]string{"out"}, actionscache.ToolkitZstd, false)).Load(ctx, "broken")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	buf := &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+
+	// the error comes after the complete archive has been extracted
+	bc, err := actionscache.NewWithBackend(&brokenBackend{data: buf.Bytes()}, actionscache.Opt{})
+	require.NoError(t, err)
+	dest := t.TempDir()
+	_, err = RestoreDirs(ctx, bc, []string{"broken"}, dest)
+	require.ErrorIs(t, err, errBroken)
+	require.Equal(t, string(dt), readFile(t, filepath.Join(dest, "out", "a.bin")))
+}
+
+func TestSaveNoFiles(t *testing.T) {
+	c, _ := actionscachetest.NewCache(t, false, actionscache.Opt{})
+	ws, _ := setup(t)
+	err := SaveDirs(context.TODO(), c, "empty", []string{"missing/*"}, Opt{Workspace: ws})
+	require.Error(t, err)
+}
+
+func TestSavePlain(t *testing.T) {
+	ctx := context.TODO()
+	c, _ := actionscachetest.NewCache(t, true, actionscache.Opt{
+		Compression:    actionscache.CodecGzip,
+		RecordDigest:   true,
+		EncryptionKeys: []actionscache.EncryptionKey{{ID: "k1", Key: bytes.Repeat([]byte("k"), 32)}},
+	})
+
+	ws, _ := setup(t)
+	writeFile(t, filepath.Join(ws, "out", "a.txt"), "a")
+	paths := []string{"out"}
+	require.NoError(t, SaveDirs(ctx, c, "build-1", paths, Opt{Workspace: ws}))
+
+	// the archive is readable without the options of the cache
+	cv := c.Plain().WithVersion(actionscache.ToolkitVersion(paths, actionscache.ToolkitZstd, false))
+	ce, err := cv.Load(ctx, "build-1")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	dgst, err := ce.Digest(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "", dgst)
+	require.Equal(t, []string{"out/", "out/a.txt"}, archiveNames(t, cv, "build-1"))
+}
@@ -0,0 +1,86 @@
+package actionscache
+
+import (
+	"context"
+	"io"
+)
+
+// Backend implements the storage primitives that Cache is built on. The
+// GitHub cache service v1 and v2 APIs are the built-in implementations, but
+// custom backends can be plugged in with NewWithBackend.
+type Backend interface {
+	// Lookup returns the entry matching one of the keys or nil if none match.
+	// Keys are tried in order and every key may match as a prefix. When
+	// multiple entries match the same prefix the newest one is returned.
+	Lookup(ctx context.Context, keys ...string) (*Entry, error)
+	// Reserve reserves a key for upload. If the key is already reserved, the
+	// returned error needs to match os.ErrExist.
+	Reserve(ctx context.Context, key string) (*Reservation, error)
+	// Upload stores the contents of the blob for the reservation.
+	Upload(ctx context.Context, r *Reservation, b Blob) error
+	// Commit finalizes the upload. The entry is not visible to Lookup before
+	// it has been committed.
+	Commit(ctx context.Context, r *Reservation, size int64) error
+}
+
+// VersionedBackend is a Backend that keeps the entries of different cache
+// versions apart. Cache calls LookupVersion and ReserveVersion with its
+// version instead of Lookup and Reserve. Backends that don't implement it
+// share their entries between all versions.
+type VersionedBackend interface {
+	Backend
+	// LookupVersion is like Lookup but only entries saved with version match.
+	LookupVersion(ctx context.Context, version string, keys ...string) (*Entry, error)
+	// ReserveVersion is like Reserve but reserves the key of version.
+	ReserveVersion(ctx context.Context, key, version string) (*Reservation, error)
+}
+
+// ExactLookupBackend is implemented by backends that can look up a key
+// without prefix matching. CAS uses it so that a longer key matching the
+// digest key as a prefix can't hide the digest.
+type ExactLookupBackend interface {
+	// LookupExact returns the entry saved with key or nil if there is none.
+	// Backends that don't implement VersionedBackend can ignore version.
+	LookupExact(ctx context.Context, version, key string) (*Entry, error)
+}
+
+// Reservation is a key reserved with Backend.Reserve.
+type Reservation struct {
+	Key string
+	// Version is set by VersionedBackend.ReserveVersion.
+	Version string
+	// ID is a backend specific identifier for the upload.
+	ID string
+}
+
+// EntrySource provides the data of an Entry returned by a custom Backend.
+type EntrySource interface {
+	// Open returns a reader for length bytes starting at offset. If length is
+	// negative the reader returns data until the end of the entry.
+	Open(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+	// Size returns the total size of the data.
+	Size(ctx context.Context) (int64, error)
+}
+
+// NewEntry returns an Entry that reads its data from src.
+func NewEntry(key, scope string, src EntrySource) *Entry {
+	return &Entry{
+		Key:   key,
+		Scope: scope,
+		src:   src,
+	}
+}
+
+// NewWithBackend returns a Cache that stores its data in backend b instead of
+// the GitHub cache service. Opt is validated the same way as in New.
+func NewWithBackend(b Backend, opt Opt) (*Cache, error) {
+	if err := opt.validate(); err != nil {
+		return nil, err
+	}
+	opt = optsWithDefaults(opt)
+	return &Cache{
+		opt:     opt,
+		backend: b,
+		logger:  newLogger(opt),
+	}, nil
+}
@@ -0,0 +1,163 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type memEntry struct {
+	key       string
+	data      []byte
+	committed bool
+}
+
+type memBackend struct {
+	mu      sync.Mutex
+	entries []*memEntry
+}
+
+func (m *memBackend) Lookup(ctx context.Context, keys ...string) (*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range keys {
+		var match *memEntry
+		for _, e := range m.entries {
+			if !e.committed {
+				continue
+			}
+			if e.key == k {
+				match = e
+				break
+			}
+			if strings.HasPrefix(e.key, k) {
+				match = e // entries are in commit order
+			}
+		}
+		if match != nil {
+			return NewEntry(match.key, "mem", bytesSource(match.data)), nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memBackend) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.entries {
+		if e.key == key {
+			return nil, errors.Wrapf(os.ErrExist, "key %s", key)
+		}
+	}
+	m.entries = append(m.entries, &memEntry{key: key})
+	return &Reservation{Key: key}, nil
+}
+
+func (m *memBackend) Upload(ctx context.Context, r *Reservation, b Blob) error {
+	dt, err := io.ReadAll(io.NewSectionReader(b, 0, b.Size()))
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.entries {
+		if e.key == r.Key {
+			e.data = dt
+		}
+	}
+	return nil
+}
+
+func (m *memBackend) Commit(ctx context.Context, r *Reservation, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, e := range m.entries {
+		if e.key == r.Key {
+			if int64(len(e.data)) != size {
+				return errors.Errorf("invalid size %d, expected %d", size, len(e.data))
+			}
+			e.committed = true
+			// keep entries in commit order
+			m.entries = append(append(m.entries[:i:i], m.entries[i+1:]...), e)
+			return nil
+		}
+	}
+	return errors.Errorf("key %s not reserved", r.Key)
+}
+
+type bytesSource []byte
+
+func (b bytesSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	var r io.Reader = io.NewSectionReader(bytes.NewReader(b), offset, int64(len(b))-offset)
+	if length >= 0 {
+		r = io.LimitReader(r, length)
+	}
+	return io.NopCloser(r), nil
+}
+
+func (b bytesSource) Size(ctx context.Context) (int64, error) {
+	return int64(len(b)), nil
+}
+
+func TestCustomBackend(t *testing.T) {
+	ctx := context.TODO()
+	_, err := NewWithBackend(&memBackend{}, Opt{UploadChunkSize: -1})
+	require.ErrorContains(t, err, "invalid upload chunk size")
+
+	c, err := NewWithBackend(&memBackend{}, Opt{})
+	require.NoError(t, err)
+
+	err = c.Save(ctx, "foo1", NewBlob([]byte("foo1")))
+	require.NoError(t, err)
+	err = c.Save(ctx, "foo2", NewBlob([]byte("foo2")))
+	require.NoError(t, err)
+
+	err = c.Save(ctx, "foo1", NewBlob([]byte("foo3")))
+	require.True(t, errors.Is(err, os.ErrExist))
+
+	ce, err := c.Load(ctx, "bar", "foo")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	require.Equal(t, "foo2", ce.Key)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	require.Equal(t, "foo2", buf.String())
+
+	rac := ce.Download(ctx)
+	dt := make([]byte, 2)
+	n, err := rac.ReadAt(dt, 1)
+	require.NoError(t, err)
+	require.Equal(t, "oo", string(dt[:n]))
+	require.NoError(t, rac.Close())
+
+	for _, s := range []string{"a", "b"} {
+		err = c.SaveMutable(ctx, "mutable", time.Second, func(ce *Entry) (Blob, error) {
+			buf := &bytes.Buffer{}
+			if ce != nil {
+				if err := ce.WriteTo(ctx, buf); err != nil {
+					return nil, err
+				}
+			}
+			buf.WriteString(s)
+			return NewBlob(buf.Bytes()), nil
+		})
+		require.NoError(t, err)
+	}
+
+	ce, err = c.Load(ctx, "mutable")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	require.Equal(t, "mutable#2", ce.Key)
+	buf = &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	require.Equal(t, "ab", buf.String())
+}
@@ -0,0 +1,138 @@
+package actionscache
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const runnerBackoffFile = "go-actions-cache-backoff"
+
+var (
+	runnerPoolsMu sync.Mutex
+	runnerPools   = map[string]*BackoffPool{}
+)
+
+// NewSharedBackoffPool returns a pool that shares its backoff with all
+// processes using the same file. When a process backs off, the others wait
+// until the same time before sending requests. The file is read at most every
+// 100ms. Errors accessing the file are logged and never block requests.
+func NewSharedBackoffPool(path string) *BackoffPool {
+	return &BackoffPool{shared: &sharedBackoff{path: path}}
+}
+
+// RunnerBackoffPool returns a pool shared by all processes of the current job
+// on a GitHub Actions runner. The state is stored in RUNNER_TEMP. Outside of
+// GitHub Actions the process-local default pool is returned.
+func RunnerBackoffPool() *BackoffPool {
+	dir := os.Getenv("RUNNER_TEMP")
+	if dir == "" {
+		return defaultBackoffPool
+	}
+	p := filepath.Join(dir, runnerBackoffFile)
+
+	runnerPoolsMu.Lock()
+	defer runnerPoolsMu.Unlock()
+	b, ok := runnerPools[p]
+	if !ok {
+		b = NewSharedBackoffPool(p)
+		runnerPools[p] = b
+	}
+	return b
+}
+
+// sharedBackoffRecheck is how long a target read from the file is reused
+// before the file is read again
+const sharedBackoffRecheck = 100 * time.Millisecond
+
+// sharedBackoff stores the time until which requests are delayed in a file
+// that is locked while it is accessed
+type sharedBackoff struct {
+	path string
+
+	mu      sync.Mutex
+	target  time.Time
+	checked time.Time
+}
+
+// load returns the stored target. A zero time is returned if no target has
+// been stored yet.
+func (s *sharedBackoff) load() (time.Time, error) {
+	if s == nil {
+		return time.Time{}, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.checked) < sharedBackoffRecheck {
+		return s.target, nil
+	}
+	s.checked = now
+	s.target = time.Time{}
+	f, err := os.Open(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, errors.WithStack(err)
+	}
+	defer f.Close()
+	if err := lockFile(f, false); err != nil {
+		return time.Time{}, err
+	}
+	defer unlockFile(f)
+	t, err := readTarget(f)
+	if err != nil {
+		return time.Time{}, err
+	}
+	s.target = t
+	return t, nil
+}
+
+// store records t unless a later target is already stored
+func (s *sharedBackoff) store(t time.Time) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	if err := lockFile(f, true); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+	if cur, err := readTarget(f); err == nil && !cur.Before(t) {
+		s.target, s.checked = cur, time.Now()
+		return nil
+	}
+	if err := f.Truncate(0); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := f.WriteAt([]byte(strconv.FormatInt(t.UnixNano(), 10)), 0); err != nil {
+		return errors.WithStack(err)
+	}
+	s.target, s.checked = t, time.Now()
+	return nil
+}
+
+func readTarget(f *os.File) (time.Time, error) {
+	dt, err := io.ReadAll(io.NewSectionReader(f, 0, 64))
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	v, err := strconv.ParseInt(string(bytes.TrimSpace(dt)), 10, 64)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	return time.Unix(0, v), nil
+}
@@ -0,0 +1,107 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTarget stores t in the shared file like another process would
+func writeTarget(t *testing.T, p string, target time.Time) {
+	require.NoError(t, os.WriteFile(p, []byte(strconv.FormatInt(target.UnixNano(), 10)), 0644))
+}
+
+func readSharedTarget(t *testing.T, p string) time.Time {
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+	target, err := readTarget(f)
+	require.NoError(t, err)
+	return target
+}
+
+func TestSharedBackoffPool(t *testing.T) {
+	ctx := context.TODO()
+	p := filepath.Join(t.TempDir(), "backoff")
+
+	b1 := NewSharedBackoffPool(p)
+	require.NoError(t, b1.Wait(ctx, time.Minute))
+
+	// a target stored by another process delays requests
+	writeTarget(t, p, time.Now().Add(time.Hour))
+	b2 := NewSharedBackoffPool(p)
+	require.ErrorContains(t, b2.Wait(ctx, 10*time.Millisecond), "maximum timeout reached")
+
+	// targets are stored for other processes, earlier ones don't shorten them
+	target := time.Now().Add(time.Hour).Round(0)
+	b3 := NewSharedBackoffPool(p)
+	b3.DelayUntil(target.Add(time.Minute))
+	require.Equal(t, target.Add(time.Minute).UnixNano(), readSharedTarget(t, p).UnixNano())
+	NewSharedBackoffPool(p).DelayUntil(target)
+	require.Equal(t, target.Add(time.Minute).UnixNano(), readSharedTarget(t, p).UnixNano())
+
+	// Delay is shared as well
+	require.NoError(t, os.Remove(p))
+	b4 := NewSharedBackoffPool(p)
+	b4.MinBackoff = time.Hour
+	b4.Delay()
+	require.Greater(t, time.Until(readSharedTarget(t, p)), 59*time.Minute)
+}
+
+func TestSharedBackoffPoolRecheck(t *testing.T) {
+	ctx := context.TODO()
+	p := filepath.Join(t.TempDir(), "backoff")
+	b := NewSharedBackoffPool(p)
+	require.NoError(t, b.Wait(ctx, time.Minute))
+
+	// the file is not read again until the recheck interval has passed
+	writeTarget(t, p, time.Now().Add(time.Hour))
+	require.NoError(t, b.Wait(ctx, time.Minute))
+
+	b.shared.mu.Lock()
+	b.shared.checked = time.Now().Add(-sharedBackoffRecheck)
+	b.shared.mu.Unlock()
+	require.ErrorContains(t, b.Wait(ctx, 10*time.Millisecond), "maximum timeout reached")
+}
+
+func TestSharedBackoffPoolErrors(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	p := filepath.Join(dir, "backoff")
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, nil))
+
+	// a broken file does not block requests but is logged
+	require.NoError(t, os.WriteFile(p, []byte("invalid"), 0644))
+	require.NoError(t, NewSharedBackoffPool(p).wait(ctx, time.Minute, log))
+	require.Contains(t, buf.String(), "failed to read shared backoff")
+
+	buf.Reset()
+	b := NewSharedBackoffPool(filepath.Join(dir, "missing", "backoff"))
+	require.NoError(t, b.wait(ctx, time.Minute, log))
+	require.Empty(t, buf.String())
+	b.delayUntil(time.Now().Add(time.Hour), log)
+	require.Contains(t, buf.String(), "failed to store shared backoff")
+}
+
+func TestRunnerBackoffPool(t *testing.T) {
+	t.Setenv("RUNNER_TEMP", "")
+	require.Same(t, defaultBackoffPool, RunnerBackoffPool())
+
+	dir := t.TempDir()
+	t.Setenv("RUNNER_TEMP", dir)
+	b := RunnerBackoffPool()
+	require.NotSame(t, defaultBackoffPool, b)
+	require.Same(t, b, RunnerBackoffPool())
+
+	b.DelayUntil(time.Now().Add(time.Hour))
+	_, err := os.Stat(filepath.Join(dir, runnerBackoffFile))
+	require.NoError(t, err)
+}
@@ -3,11 +3,10 @@ package actionscache
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -23,12 +22,28 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// UploadConcurrency is the default of Opt.UploadConcurrency. It is read when
+// a Cache is created.
+//
+// Deprecated: use Opt.UploadConcurrency.
 var UploadConcurrency = 4
+
+// UploadChunkSize is the default of Opt.UploadChunkSize. It is read when a
+// Cache is created.
+//
+// Deprecated: use Opt.UploadChunkSize.
 var UploadChunkSize = 32 * 1024 * 1024
+
+// maxUploadChunkSize is the largest block size of Azure block blobs
+const maxUploadChunkSize = 4000 * 1024 * 1024
+
 var noValidateToken bool
 
 const defaultUserAgent = "go-actions-cache/1.0"
 
+// Log receives the log messages of clients that don't set Opt.Logger.
+//
+// Deprecated: use Opt.Logger.
 var Log = func(string, ...interface{}) {}
 
 type Blob interface {
@@ -57,6 +72,56 @@ func NewBlob(dt []byte) Blob {
 	}
 }
 
+// FileBlob is a Blob of a file. Temporary files are removed on Close.
+type FileBlob struct {
+	*os.File
+	size int64
+	temp bool
+}
+
+// NewFileBlob returns a blob of the current data of f.
+func NewFileBlob(f *os.File) (*FileBlob, error) {
+	b := &FileBlob{File: f}
+	if err := b.UpdateSize(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// CreateTempBlob creates a temporary file in dir for writing the data of a
+// blob. UpdateSize needs to be called after writing the data.
+func CreateTempBlob(dir, pattern string) (*FileBlob, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &FileBlob{File: f, temp: true}, nil
+}
+
+// UpdateSize sets the size of the blob to the current size of the file.
+func (b *FileBlob) UpdateSize() error {
+	fi, err := b.File.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	b.size = fi.Size()
+	return nil
+}
+
+func (b *FileBlob) Size() int64 {
+	return b.size
+}
+
+func (b *FileBlob) Close() error {
+	err := b.File.Close()
+	if b.temp {
+		if err1 := os.Remove(b.Name()); err == nil {
+			err = err1
+		}
+	}
+	return errors.WithStack(err)
+}
+
 func TryEnv(opt Opt) (*Cache, error) {
 	var v2 bool
 	if v, ok := os.LookupEnv("ACTIONS_CACHE_SERVICE_V2"); ok {
@@ -109,10 +174,76 @@ func TryEnv(opt Opt) (*Cache, error) {
 }
 
 type Opt struct {
-	Client      *http.Client
-	Timeout     time.Duration
+	Client  *http.Client
+	Timeout time.Duration
+	// BackoffPool delays requests after rate limits. Defaults to a pool
+	// shared within the process. RunnerBackoffPool shares it with other
+	// processes on the same runner.
 	BackoffPool *BackoffPool
+	// RetryPolicy decides which failed idempotent requests, such as lookups,
+	// upload chunks and commits, are retried within Timeout. Defaults to
+	// ExponentialRetryPolicy.
+	RetryPolicy RetryPolicy
 	UserAgent   string
+	// Version namespaces entries. Entries are only visible to clients using
+	// the same version. Use ToolkitVersion to share caches with the
+	// actions/cache action. Custom backends only support versions if they
+	// implement VersionedBackend.
+	Version string
+	// UploadJournalDir enables resumable v1 uploads. The progress of every
+	// upload is recorded in this directory, and a Save of a key left reserved
+	// by an interrupted upload of the same data continues with the missing
+	// chunks. Processes saving the same key should not share the directory.
+	UploadJournalDir string
+	// Compression compresses saved data with the codec. The codec is recorded
+	// with the entry and data is decompressed automatically when read.
+	Compression Codec
+	// EncryptionKeys enables encryption of saved data with AES-GCM. The first
+	// key is used for encrypting, the others are only used for reading
+	// entries saved before the key was rotated. No digest is recorded for
+	// encrypted entries as the encryption already protects their integrity.
+	EncryptionKeys []EncryptionKey
+	// RecordDigest stores the SHA-256 digest of saved data with the entry.
+	// The digest is verified when the entry is read with WriteTo or
+	// DownloadTo.
+	RecordDigest bool
+	// APIURL is the base URL of the GitHub REST API used by RestAPI. Defaults
+	// to https://api.github.com. For GitHub Enterprise Server the instance URL
+	// can be used directly, the /api/v3 prefix is added to URLs without a path
+	// unless the host is an api.* host or RawAPIURL is set.
+	APIURL string
+	// RawAPIURL uses APIURL as is without adding the /api/v3 prefix. Useful
+	// for test servers that serve the REST API from the root.
+	RawAPIURL bool
+	// Logger receives structured logs of cache operations. Signed URLs are
+	// redacted. If not set, messages are formatted and passed to Log.
+	Logger *slog.Logger
+	// UploadConcurrency is the number of chunks uploaded in parallel.
+	// Defaults to 4.
+	UploadConcurrency int
+	// UploadChunkSize is the size of the chunks data is uploaded in, up to
+	// 4000MiB. Defaults to 32MiB.
+	UploadChunkSize int64
+	// DownloadConcurrency is the number of ranges fetched in parallel by
+	// Entry.DownloadTo and Entry.Download. Defaults to 4.
+	DownloadConcurrency int
+	// DownloadChunkSize is the size of the ranges requested by
+	// Entry.DownloadTo. Defaults to 32MiB.
+	DownloadChunkSize int64
+	// TransferScheduler caps the number of chunk requests in flight. Defaults
+	// to DefaultTransferScheduler, which is shared by the whole process.
+	TransferScheduler *TransferScheduler
+	// Progress is called with the progress of Save, SaveMutable and of
+	// WriteTo and DownloadTo of loaded entries. Calls are synchronous and
+	// should return quickly.
+	Progress func(Progress)
+	// RateLimiter limits the bandwidth of uploads and downloads of this Cache.
+	// It applies in addition to DefaultRateLimiter.
+	RateLimiter *RateLimiter
+	// ProgressInterval is the minimum time between two Progress calls of the
+	// same operation. Phase changes and the final call are always reported.
+	// Defaults to 100ms.
+	ProgressInterval time.Duration
 }
 
 func New(token, url string, v2 bool, opt Opt) (*Cache, error) {
@@ -165,11 +296,18 @@ func New(token, url string, v2 bool, opt Opt) (*Cache, error) {
 	if err := json.Unmarshal([]byte(acs), &scopes); err != nil {
 		return nil, errors.Wrap(err, "failed to parse token access controls")
 	}
-	Log("parsed token: scopes: %+v, issued: %v, expires: %v", scopes, nbft, expt)
-
+	if err := opt.validate(); err != nil {
+		return nil, err
+	}
 	opt = optsWithDefaults(opt)
+	api := "v1"
+	if v2 {
+		api = "v2"
+	}
+	logger := newLogger(opt, "api", api)
+	logger.Debug("parsed token", "scopes", scopes, "issued", nbft, "expires", expt)
 
-	return &Cache{
+	c := &Cache{
 		opt:       opt,
 		scopes:    scopes,
 		URL:       url,
@@ -177,7 +315,14 @@ func New(token, url string, v2 bool, opt Opt) (*Cache, error) {
 		IssuedAt:  nbft,
 		ExpiresAt: expt,
 		IsV2:      v2,
-	}, nil
+		logger:    logger,
+	}
+	if v2 {
+		c.backend = &backendV2{c: c}
+	} else {
+		c.backend = &backendV1{c: c}
+	}
+	return c, nil
 }
 
 func optsWithDefaults(opt Opt) Opt {
@@ -190,12 +335,46 @@ func optsWithDefaults(opt Opt) Opt {
 	if opt.BackoffPool == nil {
 		opt.BackoffPool = defaultBackoffPool
 	}
+	if opt.RetryPolicy == nil {
+		opt.RetryPolicy = &ExponentialRetryPolicy{}
+	}
 	if opt.UserAgent == "" {
 		opt.UserAgent = defaultUserAgent
 	}
+	if opt.UploadConcurrency <= 0 {
+		opt.UploadConcurrency = max(1, UploadConcurrency)
+	}
+	if opt.UploadChunkSize <= 0 || opt.UploadChunkSize > maxUploadChunkSize {
+		opt.UploadChunkSize = int64(max(1, UploadChunkSize))
+	}
+	if opt.DownloadConcurrency <= 0 {
+		opt.DownloadConcurrency = defaultDownloadConcurrency
+	}
+	if opt.DownloadChunkSize <= 0 {
+		opt.DownloadChunkSize = defaultDownloadChunkSize
+	}
+	if opt.TransferScheduler == nil {
+		opt.TransferScheduler = defaultTransferScheduler
+	}
 	return opt
 }
 
+func (opt Opt) validate() error {
+	if opt.UploadConcurrency < 0 {
+		return errors.Errorf("invalid upload concurrency %d", opt.UploadConcurrency)
+	}
+	if opt.UploadChunkSize < 0 || opt.UploadChunkSize > maxUploadChunkSize {
+		return errors.Errorf("invalid upload chunk size %d, maximum is %d", opt.UploadChunkSize, maxUploadChunkSize)
+	}
+	if opt.DownloadConcurrency < 0 {
+		return errors.Errorf("invalid download concurrency %d", opt.DownloadConcurrency)
+	}
+	if opt.DownloadChunkSize < 0 {
+		return errors.Errorf("invalid download chunk size %d", opt.DownloadChunkSize)
+	}
+	return nil
+}
+
 type Scope struct {
 	Scope      string
 	Permission Permission
@@ -230,6 +409,11 @@ type Cache struct {
 	IssuedAt  time.Time
 	ExpiresAt time.Time
 	IsV2      bool
+
+	backend Backend
+	logger  *slog.Logger
+	// plain disables the envelope options of opt for saving
+	plain bool
 }
 
 func (c *Cache) Scopes() []Scope {
@@ -237,24 +421,116 @@ func (c *Cache) Scopes() []Scope {
 }
 
 func (c *Cache) Load(ctx context.Context, keys ...string) (*Entry, error) {
-	if c.IsV2 {
-		return c.loadV2(ctx, keys...)
+	return c.load(ctx, keys, func() (*Entry, error) {
+		return c.lookup(ctx, keys...)
+	})
+}
+
+// loadExact loads the entry saved with key without prefix matching
+func (c *Cache) loadExact(ctx context.Context, b ExactLookupBackend, key string) (*Entry, error) {
+	return c.load(ctx, []string{key}, func() (*Entry, error) {
+		return b.LookupExact(ctx, c.version(), key)
+	})
+}
+
+func (c *Cache) load(ctx context.Context, keys []string, lookup func() (*Entry, error)) (*Entry, error) {
+	start := time.Now()
+	ce, err := lookup()
+	if err != nil {
+		c.log().Debug("load cache failed", "operation", "load", "keys", keys, errAttr(err))
+		return nil, err
+	}
+	if ce == nil {
+		c.log().Debug("cache miss", "operation", "load", "keys", keys, "duration", time.Since(start))
+		return nil, nil
+	}
+	ce.keys = c.opt.EncryptionKeys
+	ce.logger = c.log()
+	ce.dl = DownloadOpt{Concurrency: c.opt.DownloadConcurrency, ChunkSize: c.opt.DownloadChunkSize}
+	ce.sched = c.opt.TransferScheduler
+	ce.progress = c.progress()
+	ce.limiters = c.rateLimiters()
+	c.log().Debug("cache hit", "operation", "load", "keys", keys, "key", ce.Key, "scope", ce.Scope, "duration", time.Since(start))
+	return ce, nil
+}
+
+func (c *Cache) lookup(ctx context.Context, keys ...string) (*Entry, error) {
+	if b, ok := c.backend.(VersionedBackend); ok {
+		return b.LookupVersion(ctx, c.version(), keys...)
+	}
+	return c.backend.Lookup(ctx, keys...)
+}
+
+// backendV1 implements VersionedBackend with the v1 artifactcache API
+type backendV1 struct {
+	c *Cache
+}
+
+func (b *backendV1) Lookup(ctx context.Context, keys ...string) (*Entry, error) {
+	return b.LookupVersion(ctx, defaultVersion, keys...)
+}
+
+func (b *backendV1) LookupVersion(ctx context.Context, version string, keys ...string) (*Entry, error) {
+	return b.c.loadV1(ctx, version, keys...)
+}
+
+func (b *backendV1) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return b.ReserveVersion(ctx, key, defaultVersion)
+}
+
+func (b *backendV1) ReserveVersion(ctx context.Context, key, version string) (*Reservation, error) {
+	cid, err := b.c.reserveV1(ctx, key, version)
+	if err != nil {
+		if b.c.opt.UploadJournalDir != "" && errors.Is(err, os.ErrExist) {
+			if r, err2 := b.c.resumeV1(ctx, key, version); err2 != nil || r != nil {
+				return r, err2
+			}
+		}
+		return nil, err
+	}
+	r := &Reservation{Key: key, Version: version, ID: strconv.Itoa(cid)}
+	if b.c.opt.UploadJournalDir != "" {
+		if _, err := b.c.newJournal(key, r.ID); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (b *backendV1) Upload(ctx context.Context, r *Reservation, blob Blob) error {
+	if b.c.opt.UploadJournalDir == "" {
+		return b.c.uploadV1(ctx, r.ID, blob)
 	}
-	return c.loadV1(ctx, keys...)
+	err := b.c.uploadV1Journal(ctx, r, blob)
+	b.c.dropJournalOnError(r.Key, err)
+	return err
 }
 
-func (c *Cache) loadV1(ctx context.Context, keys ...string) (*Entry, error) {
+func (b *backendV1) Commit(ctx context.Context, r *Reservation, size int64) error {
+	err := b.c.commitV1(ctx, r.ID, size)
+	if b.c.opt.UploadJournalDir != "" {
+		if err == nil {
+			if j, _ := b.c.loadJournal(r.Key); j != nil {
+				j.remove()
+			}
+		}
+		b.c.dropJournalOnError(r.Key, err)
+	}
+	return err
+}
+
+func (c *Cache) loadV1(ctx context.Context, version string, keys ...string) (*Entry, error) {
 	u, err := url.Parse(c.url("cache"))
 	if err != nil {
 		return nil, err
 	}
 	q := u.Query()
 	q.Set("keys", strings.Join(keys, ","))
-	q.Set("version", version(keys[0]))
+	q.Set("version", version)
 	u.RawQuery = q.Encode()
 
 	req := c.newRequest("GET", u.String(), nil)
-	Log("load cache %s", u.String())
+	req.idempotent = true
 	resp, err := c.doWithRetries(ctx, req)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -277,24 +553,16 @@ func (c *Cache) loadV1(ctx context.Context, keys ...string) (*Entry, error) {
 	return &ce, nil
 }
 
-func (c *Cache) reserve(ctx context.Context, key string) (string, string, error) {
-	if c.IsV2 {
-		url, err := c.reserveV2(ctx, key)
-		if err != nil {
-			return "", "", err
-		}
-		return key, url, nil
-	}
-	cid, err := c.reserveV1(ctx, key)
-	if err != nil {
-		return "", "", err
+func (c *Cache) reserve(ctx context.Context, key string) (*Reservation, error) {
+	progressFrom(ctx).phase(PhaseReserve, key, -1)
+	if b, ok := c.backend.(VersionedBackend); ok {
+		return b.ReserveVersion(ctx, key, c.version())
 	}
-	sid := strconv.Itoa(cid)
-	return sid, sid, nil
+	return c.backend.Reserve(ctx, key)
 }
 
-func (c *Cache) reserveV1(ctx context.Context, key string) (int, error) {
-	dt, err := json.Marshal(ReserveCacheReq{Key: key, Version: version(key)})
+func (c *Cache) reserveV1(ctx context.Context, key, version string) (int, error) {
+	dt, err := json.Marshal(ReserveCacheReq{Key: key, Version: version})
 	if err != nil {
 		return 0, errors.WithStack(err)
 	}
@@ -303,7 +571,6 @@ func (c *Cache) reserveV1(ctx context.Context, key string) (int, error) {
 	})
 
 	req.headers["Content-Type"] = "application/json"
-	Log("save cache req %s body=%s", req.url, dt)
 	resp, err := c.doWithRetries(ctx, req)
 	if err != nil {
 		return 0, errors.WithStack(err)
@@ -320,15 +587,13 @@ func (c *Cache) reserveV1(ctx context.Context, key string) (int, error) {
 	if cr.CacheID == 0 {
 		return 0, errors.Errorf("invalid response %s", dt)
 	}
-	Log("save cache resp: %s", dt)
+	c.log().Debug("reserved cache", "operation", "reserve", "key", key, "cache_id", cr.CacheID)
 	return cr.CacheID, nil
 }
 
-func (c *Cache) commit(ctx context.Context, id string, size int64) error {
-	if c.IsV2 {
-		return c.commitV2(ctx, id, size)
-	}
-	return c.commitV1(ctx, id, size)
+func (c *Cache) commit(ctx context.Context, r *Reservation, size int64) error {
+	progressFrom(ctx).phase(PhaseCommit, r.Key, size)
+	return c.backend.Commit(ctx, r, size)
 }
 
 func (c *Cache) commitV1(ctx context.Context, id string, size int64) error {
@@ -340,51 +605,74 @@ func (c *Cache) commitV1(ctx context.Context, id string, size int64) error {
 		return bytes.NewReader(dt)
 	})
 	req.headers["Content-Type"] = "application/json"
-	Log("commit cache %s, size %d", req.url, size)
+	req.idempotent = true
 	resp, err := c.doWithRetries(ctx, req)
 	if err != nil {
 		return errors.Wrapf(err, "error committing cache %s", id)
 	}
-	dt, err = io.ReadAll(io.LimitReader(resp.Body, 32*1024))
-	if err != nil {
-		return err
-	}
-	if len(dt) != 0 {
-		Log("commit response: %s", dt)
+	if _, err := io.Copy(io.Discard, io.LimitReader(resp.Body, 32*1024)); err != nil {
+		return errors.WithStack(err)
 	}
+	c.log().Debug("committed cache", "operation", "commit", "cache_id", id, "bytes", size)
 	return resp.Body.Close()
 }
 
-func (c *Cache) upload(ctx context.Context, url string, b Blob) error {
-	if c.IsV2 {
-		return c.uploadV2(ctx, url, b)
-	}
-	return c.uploadV1(ctx, url, b)
+func (c *Cache) upload(ctx context.Context, r *Reservation, b Blob) error {
+	progressFrom(ctx).phase(PhaseUpload, r.Key, b.Size())
+	return c.backend.Upload(ctx, r, b)
 }
 
 func (c *Cache) uploadV1(ctx context.Context, id string, b Blob) error {
+	return c.uploadV1Ranges(ctx, id, b, []journalChunk{{Start: 0, End: b.Size()}}, nil)
+}
+
+// uploadV1Ranges uploads the ranges of b in chunks. If ack is set it is
+// called for every chunk acknowledged by the server.
+func (c *Cache) uploadV1Ranges(ctx context.Context, id string, b Blob, ranges []journalChunk, ack func(start, end int64) error) error {
+	var missing int64
+	var chunks int
+	for _, r := range ranges {
+		missing += r.End - r.Start
+		chunks += int((r.End - r.Start + c.opt.UploadChunkSize - 1) / c.opt.UploadChunkSize)
+	}
+	p := progressFrom(ctx)
+	p.chunks(chunks)
+	// data uploaded before resuming
+	p.add(b.Size() - missing)
+
 	var mu sync.Mutex
 	eg, ctx := errgroup.WithContext(ctx)
-	offset := int64(0)
-	for i := 0; i < UploadConcurrency; i++ {
+	var offset int64
+	if len(ranges) > 0 {
+		offset = ranges[0].Start
+	}
+	for i := 0; i < c.opt.UploadConcurrency; i++ {
 		eg.Go(func() error {
 			for {
 				mu.Lock()
-				start := offset
-				if start >= b.Size() {
+				for len(ranges) > 0 && offset >= ranges[0].End {
+					ranges = ranges[1:]
+					if len(ranges) > 0 {
+						offset = ranges[0].Start
+					}
+				}
+				if len(ranges) == 0 {
 					mu.Unlock()
 					return nil
 				}
-				end := start + int64(UploadChunkSize)
-				if end > b.Size() {
-					end = b.Size()
-				}
+				start := offset
+				end := min(start+c.opt.UploadChunkSize, ranges[0].End)
 				offset = end
 				mu.Unlock()
 
 				if err := c.uploadChunk(ctx, id, b, start, end-start); err != nil {
 					return err
 				}
+				if ack != nil {
+					if err := ack(start, end); err != nil {
+						return err
+					}
+				}
 			}
 		})
 	}
@@ -392,16 +680,29 @@ func (c *Cache) uploadV1(ctx context.Context, id string, b Blob) error {
 }
 
 func (c *Cache) Save(ctx context.Context, key string, b Blob) error {
-	id, url, err := c.reserve(ctx, key)
+	p := c.progress().start(key)
+	err := c.save(withProgress(ctx, p), key, b)
+	p.finish(err)
+	return err
+}
+
+func (c *Cache) save(ctx context.Context, key string, b Blob) error {
+	b, err := c.encode(key, b)
 	if err != nil {
 		return err
 	}
+	defer b.Close()
 
-	if err := c.upload(ctx, url, b); err != nil {
+	r, err := c.reserve(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if err := c.upload(ctx, r, b); err != nil {
 		return err
 	}
 
-	return c.commit(ctx, id, b.Size())
+	return c.commit(ctx, r, b.Size())
 }
 
 // SaveMutable stores a blob over a possibly existing key. Previous value is passed to callback
@@ -409,6 +710,13 @@ func (c *Cache) Save(ctx context.Context, key string, b Blob) error {
 // same time window. In case of a crash a key may remain locked, preventing previous changes. Timeout
 // can be set to force changes in this case without guaranteeing that previous value was up to date.
 func (c *Cache) SaveMutable(ctx context.Context, key string, forceTimeout time.Duration, f func(old *Entry) (Blob, error)) error {
+	p := c.progress().start(key)
+	err := c.saveMutable(withProgress(ctx, p), key, forceTimeout, f)
+	p.finish(err)
+	return err
+}
+
+func (c *Cache) saveMutable(ctx context.Context, key string, forceTimeout time.Duration, f func(old *Entry) (Blob, error)) error {
 	var blocked time.Duration
 loop0:
 	for {
@@ -421,6 +729,12 @@ loop0:
 			return err
 		}
 		defer b.Close()
+		// index keys are not resumed
+		b, err = c.encode("", b)
+		if err != nil {
+			return err
+		}
+		defer b.Close()
 		if ce != nil {
 			// check if index changed while loading
 			ce2, err := c.Load(ctx, key+"#")
@@ -442,11 +756,15 @@ loop0:
 				return errors.Wrapf(err, "failed to parse %s index", key)
 			}
 		}
-		var cacheID string
-		var url string
+		var r *Reservation
 		for {
 			idx++
-			cacheID, url, err = c.reserve(ctx, fmt.Sprintf("%s#%d", key, idx))
+			r, err = c.reserve(ctx, fmt.Sprintf("%s#%d", key, idx))
+			if err == nil {
+				// upload fails with os.ErrExist if the key is reserved by an
+				// interrupted upload of different data
+				err = c.upload(ctx, r, b)
+			}
 			if err != nil {
 				if errors.Is(err, os.ErrExist) {
 					if blocked <= forceTimeout {
@@ -464,32 +782,36 @@ loop0:
 			}
 			break
 		}
-		if err := c.upload(ctx, url, b); err != nil {
-			return nil
-		}
-		return c.commit(ctx, cacheID, b.Size())
+		return c.commit(ctx, r, b.Size())
 	}
 }
 
 func (c *Cache) uploadChunk(ctx context.Context, id string, ra io.ReaderAt, off, n int64) error {
+	p := progressFrom(ctx)
+	pr := newProgressReader(io.NewSectionReader(ra, off, n), p)
 	req := c.newRequest("PATCH", c.url(fmt.Sprintf("caches/%s", id)), func() io.Reader {
-		return io.NewSectionReader(ra, off, n)
+		pr.Seek(0, io.SeekStart)
+		return newRateLimitReader(ctx, pr, c.rateLimiters())
 	})
 	req.headers["Content-Type"] = "application/octet-stream"
 	req.headers["Content-Range"] = fmt.Sprintf("bytes %d-%d/*", off, off+n-1)
+	req.idempotent = true
+
+	if err := c.opt.TransferScheduler.acquire(ctx); err != nil {
+		return err
+	}
+	defer c.opt.TransferScheduler.release()
 
-	Log("upload cache chunk %s, range %d-%d", req.url, off, off+n-1)
+	start := time.Now()
 	resp, err := c.doWithRetries(ctx, req)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	dt, err := io.ReadAll(io.LimitReader(resp.Body, 32*1024))
-	if err != nil {
+	if _, err := io.Copy(io.Discard, io.LimitReader(resp.Body, 32*1024)); err != nil {
 		return errors.WithStack(err)
 	}
-	if len(dt) != 0 {
-		Log("upload chunk resp: %s", dt)
-	}
+	c.log().Debug("uploaded chunk", "operation", "upload", "cache_id", id, rangeAttr(off, n), "bytes", n, "duration", time.Since(start))
+	p.chunk()
 	return resp.Body.Close()
 }
 
@@ -507,41 +829,19 @@ func (c *Cache) newRequest(method, url string, body func() io.Reader) *request {
 }
 
 func (c *Cache) doWithRetries(ctx context.Context, r *request) (*http.Response, error) {
-	var lastErr error
-	max := time.Now().Add(c.opt.Timeout)
-	for {
-		if err1 := c.opt.BackoffPool.Wait(ctx, time.Until(max)); err1 != nil {
-			if lastErr != nil {
-				return nil, errors.Wrapf(lastErr, "%v", err1)
-			}
-			return nil, err1
-		}
-		req, err := r.httpReq()
-		if err != nil {
-			return nil, err
-		}
-		req = req.WithContext(ctx)
+	return doWithRetries(ctx, c.opt, c.log(), retryOpt{
+		idempotent: r.idempotent,
+		rateLimited: func(resp *http.Response) bool {
+			return resp.StatusCode == http.StatusTooManyRequests
+		},
+	}, r.httpReq)
+}
 
-		var resp *http.Response
-		resp, err = c.opt.Client.Do(req)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		if err := checkResponse(resp); err != nil {
-			var he HTTPError
-			if errors.As(err, &he) {
-				if he.StatusCode == http.StatusTooManyRequests {
-					c.opt.BackoffPool.Delay()
-					lastErr = err
-					continue
-				}
-			}
-			c.opt.BackoffPool.Reset()
-			return nil, err
-		}
-		c.opt.BackoffPool.Reset()
-		return resp, nil
+func withAttempts(err error, attempts int) error {
+	if attempts <= 1 {
+		return err
 	}
+	return errors.Wrapf(err, "failed after %d attempts", attempts)
 }
 
 func (c *Cache) url(p string) string {
@@ -592,55 +892,150 @@ type Entry struct {
 	URL         string `json:"archiveLocation"`
 	IsAzureBlob bool   `json:"isAzureBlob"`
 
-	client *http.Client
-	reload func(context.Context) error
+	client   *http.Client
+	logger   *slog.Logger
+	dl       DownloadOpt
+	sched    *TransferScheduler
+	progress progressConfig
+	limiters []*RateLimiter
+	reload   func(context.Context) error
+	src      EntrySource
+	mu       sync.Mutex // protects URL on reload
+
+	decodeMu sync.Mutex
+	dec      *decodedEntry
+	keys     []EncryptionKey
 }
 
+// WriteTo writes the entry data to w. If a digest was recorded on save, the
+// data is verified and ErrDigestMismatch is returned if it does not match.
 func (ce *Entry) WriteTo(ctx context.Context, w io.Writer) error {
-	rac := ce.Download(ctx)
-	if _, err := io.Copy(w, &rc{ReaderAt: rac}); err != nil {
+	p := ce.progress.start(ce.Key)
+	err := ce.writeTo(withProgress(ctx, p), w)
+	p.finish(err)
+	return err
+}
+
+func (ce *Entry) writeTo(ctx context.Context, w io.Writer) error {
+	rc, err := ce.reader(ctx)
+	if err != nil {
 		return err
 	}
-	return rac.Close()
+	defer rc.Close()
+	if _, err := io.Copy(w, rc); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
 }
 
-// Download returns a ReaderAtCloser for pulling the data. Concurrent reads are not allowed
+// Download returns a ReaderAtCloser for pulling the data. Concurrent reads are
+// allowed. Data is fetched in blocks that are cached and read ahead for
+// sequential access. The digest of the data is not verified.
 func (ce *Entry) Download(ctx context.Context) ReaderAtCloser {
-	if ce.IsAzureBlob {
-		return ce.downloadV2(ctx)
+	return newReaderAtCloser(ctx, (*entrySource)(ce), DownloadOpt{}.withDefaults(ce.dl).Concurrency, ce.sched)
+}
+
+// Size returns the size of the entry data.
+func (ce *Entry) Size(ctx context.Context) (int64, error) {
+	return (*entrySource)(ce).Size(ctx)
+}
+
+func (ce *Entry) source() EntrySource {
+	var src EntrySource
+	switch {
+	case ce.src != nil:
+		src = ce.src
+	case ce.IsAzureBlob:
+		src = (*azureSource)(ce)
+	default:
+		src = (*httpSource)(ce)
 	}
-	return toReaderAtCloser(func(offset int64) (io.ReadCloser, error) {
-		req, err := http.NewRequest("GET", ce.URL, nil)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		req = req.WithContext(ctx)
-		if offset != 0 {
-			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	if len(ce.limiters) > 0 {
+		src = &rateLimitSource{src: src, limiters: ce.limiters}
+	}
+	return src
+}
+
+// httpSource reads entry data from a plain HTTP archive location
+type httpSource Entry
+
+func (ce *httpSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(&bytes.Reader{}), nil
+	}
+	req, err := http.NewRequest("GET", ce.URL, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	if length >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset != 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	client := ce.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, errors.Errorf("invalid status response %v for %s, range: %v", resp.Status, ce.URL, req.Header.Get("Range"))
 		}
-		client := ce.client
-		if client == nil {
-			client = http.DefaultClient
+		return nil, errors.Errorf("invalid status response %v for %s", resp.Status, ce.URL)
+	}
+	if req.Header.Get("Range") != "" {
+		cr := resp.Header.Get("content-range")
+		if !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			return nil, errors.Errorf("unhandled content range in response: %v", cr)
 		}
-		resp, err := client.Do(req)
-		if err != nil {
-			return nil, errors.WithStack(err)
+	}
+	return resp.Body, nil
+}
+
+func (ce *httpSource) Size(ctx context.Context) (int64, error) {
+	req, err := http.NewRequest("GET", ce.URL, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", "bytes=0-0")
+	client := ce.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// range not supported, full content was returned
+		if resp.ContentLength < 0 {
+			return 0, errors.Errorf("unknown size for %s", ce.URL)
 		}
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
-				return nil, errors.Errorf("invalid status response %v for %s, range: %v", resp.Status, ce.URL, req.Header.Get("Range"))
-			}
-			return nil, errors.Errorf("invalid status response %v for %s", resp.Status, ce.URL)
+		return resp.ContentLength, nil
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// "bytes 0-0/size" or "bytes */0" for empty blobs
+		cr := resp.Header.Get("content-range")
+		_, total, ok := strings.Cut(cr, "/")
+		if !ok {
+			return 0, errors.Errorf("invalid content range %q for %s", cr, ce.URL)
 		}
-		if offset != 0 {
-			cr := resp.Header.Get("content-range")
-			if !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-", offset)) {
-				resp.Body.Close()
-				return nil, errors.Errorf("unhandled content range in response: %v", cr)
-			}
+		size, err := strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return 0, errors.Errorf("invalid content range %q for %s", cr, ce.URL)
 		}
-		return resp.Body, nil
-	})
+		return size, nil
+	default:
+		return 0, errors.Errorf("invalid status response %v for %s", resp.Status, ce.URL)
+	}
 }
 
 type request struct {
@@ -648,6 +1043,8 @@ type request struct {
 	url     string
 	body    func() io.Reader
 	headers map[string]string
+	// idempotent requests are retried on errors allowed by Opt.RetryPolicy
+	idempotent bool
 }
 
 func (r *request) httpReq() (*http.Request, error) {
@@ -665,19 +1062,13 @@ func (r *request) httpReq() (*http.Request, error) {
 	return req, nil
 }
 
-func version(k string) string {
-	h := sha256.New()
-	// h.Write([]byte(k))
-	// upstream uses paths in version, we don't seem to have anything that is unique like this
-	h.Write([]byte("|go-actionscache-1.0"))
-	return hex.EncodeToString(h.Sum(nil))
-}
-
 type GithubAPIError struct {
 	Message   string `json:"message"`
 	TypeName  string `json:"typeName"`
 	TypeKey   string `json:"typeKey"`
 	ErrorCode int    `json:"errorCode"`
+	// DocumentationURL is set by the REST API
+	DocumentationURL string `json:"documentation_url,omitempty"`
 }
 
 func (e GithubAPIError) Error() string {
@@ -107,20 +107,16 @@ func TestExistingKey(t *testing.T) {
 func TestChunkedSave(t *testing.T) {
 	ctx := context.TODO()
 
-	c, err := TryEnv(Opt{})
+	c, err := TryEnv(Opt{UploadChunkSize: 2})
 	require.NoError(t, err)
 	if c == nil {
 		t.SkipNow()
 	}
-	oldChunkSize := UploadChunkSize
-	UploadChunkSize = 2
 
 	id := newID()
 	err = c.Save(ctx, id, NewBlob([]byte("0123456789")))
 	require.NoError(t, err)
 
-	UploadChunkSize = oldChunkSize
-
 	// v2 API is not immediately consistent
 	time.Sleep(2 * time.Second)
 
@@ -333,7 +329,7 @@ func TestMutableCrash(t *testing.T) {
 
 	// reserve key but don't do anything, as if crashed
 	idx := 1
-	_, _, err = c.reserve(ctx, fmt.Sprintf("%s#%d", key, idx))
+	_, err = c.reserve(ctx, fmt.Sprintf("%s#%d", key, idx))
 	require.NoError(t, err)
 
 	count := 0
@@ -3,28 +3,67 @@ package actionscache
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
-func (c *Cache) reserveV2(ctx context.Context, key string) (string, error) {
-	dt, err := json.Marshal(ReserveCacheReq{Key: key, Version: version(key)})
+// backendV2 implements VersionedBackend with the v2 CacheService Twirp API.
+// Reservation ID is the signed upload URL.
+type backendV2 struct {
+	c *Cache
+}
+
+func (b *backendV2) Lookup(ctx context.Context, keys ...string) (*Entry, error) {
+	return b.LookupVersion(ctx, defaultVersion, keys...)
+}
+
+func (b *backendV2) LookupVersion(ctx context.Context, version string, keys ...string) (*Entry, error) {
+	return b.c.loadV2(ctx, version, keys...)
+}
+
+func (b *backendV2) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return b.ReserveVersion(ctx, key, defaultVersion)
+}
+
+func (b *backendV2) ReserveVersion(ctx context.Context, key, version string) (*Reservation, error) {
+	url, err := b.c.reserveV2(ctx, key, version)
+	if err != nil {
+		return nil, err
+	}
+	return &Reservation{Key: key, Version: version, ID: url}, nil
+}
+
+func (b *backendV2) Upload(ctx context.Context, r *Reservation, blob Blob) error {
+	return b.c.uploadV2(ctx, r.ID, blob)
+}
+
+func (b *backendV2) Commit(ctx context.Context, r *Reservation, size int64) error {
+	return b.c.commitV2(ctx, r.Key, r.Version, size)
+}
+
+func (c *Cache) reserveV2(ctx context.Context, key, version string) (string, error) {
+	dt, err := json.Marshal(ReserveCacheReq{Key: key, Version: version})
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
 	req := c.newRequestV2(c.urlV2("CreateCacheEntry"), func() io.Reader {
 		return bytes.NewReader(dt)
 	})
-	Log("save cache req %s body=%s", req.url, dt)
 	resp, err := c.doWithRetries(ctx, req)
 	if err != nil {
 		return "", errors.WithStack(err)
@@ -35,7 +74,6 @@ func (c *Cache) reserveV2(ctx context.Context, key string) (string, error) {
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
-	Log("save cache resp %s body=%s", req.url, dt)
 	var cr struct {
 		OK              bool   `json:"ok"`
 		SignedUploadURL string `json:"signed_upload_url"`
@@ -47,6 +85,7 @@ func (c *Cache) reserveV2(ctx context.Context, key string) (string, error) {
 	if !cr.OK {
 		return "", errors.New("failed to reserve cache")
 	}
+	c.log().Debug("reserved cache", "operation", "reserve", "key", key, "url", redactURL(cr.SignedUploadURL))
 	return cr.SignedUploadURL, nil
 }
 
@@ -66,49 +105,184 @@ func (c *Cache) uploadV2(ctx context.Context, url string, b Blob) error {
 		return errors.WithStack(err)
 	}
 
-	// uploading with sized blocks requires io.File ¯\_(ツ)_/¯
-	resp, err := client.UploadStream(ctx, &rc{ReaderAt: b}, nil)
+	start := time.Now()
+	size := b.Size()
+	chunkSize := c.opt.UploadChunkSize
+	blockIDs := make([]string, (size+chunkSize-1)/chunkSize)
+	progressFrom(ctx).chunks(len(blockIDs))
+
+	var mu sync.Mutex
+	next := 0
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i := 0; i < c.opt.UploadConcurrency; i++ {
+		eg.Go(func() error {
+			for {
+				mu.Lock()
+				idx := next
+				if idx >= len(blockIDs) {
+					mu.Unlock()
+					return nil
+				}
+				next++
+				mu.Unlock()
+
+				off := int64(idx) * chunkSize
+				n := min(chunkSize, size-off)
+				// block IDs need to have the same length within a blob
+				id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", idx)))
+				if err := c.stageBlock(egCtx, client, id, b, off, n); err != nil {
+					return err
+				}
+				blockIDs[idx] = id
+			}
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	resp, err := client.CommitBlockList(ctx, blockIDs, nil)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	Log("upload cache %s %s", url, *resp.RequestID)
+	c.log().Debug("uploaded blob", "operation", "upload", "url", redactURL(url), "request_id", *resp.RequestID, "blocks", len(blockIDs), "bytes", size, "duration", time.Since(start))
 	return nil
 }
 
-func (ce *Entry) downloadV2(ctx context.Context) ReaderAtCloser {
-	return toReaderAtCloser(func(offset int64) (io.ReadCloser, error) {
-		var retried bool
-		for {
-			client, err := blockblob.NewClientWithNoCredential(ce.URL, azureOptions)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-			resp, err := client.DownloadStream(ctx, &blob.DownloadStreamOptions{
-				Range: blob.HTTPRange{Offset: offset},
-			})
-			if err != nil {
-				if !retried {
-					// the URL might have expired, so we try to load it again
-					retried = true
-					var respErr *azcore.ResponseError
-					if errors.As(err, &respErr) {
-						if respErr.StatusCode == http.StatusForbidden || respErr.StatusCode == http.StatusUnauthorized {
-							Log("reload download URL because error %v", err)
-							if err := ce.reload(ctx); err != nil {
-								return nil, errors.WithStack(err)
-							}
-							continue // retry with the new URL
+const stageBlockAttempts = 5
+
+var stageBlockRetryDelay = time.Second
+
+// stageBlock uploads a single block. The block is retried independently of
+// other blocks so a single failure does not restart the whole upload. Retries
+// of the azure pipeline are disabled for the request so that they don't
+// multiply with the attempts here.
+func (c *Cache) stageBlock(ctx context.Context, client *blockblob.Client, id string, ra io.ReaderAt, off, n int64) error {
+	log := c.log()
+	p := progressFrom(ctx)
+	pr := newProgressReader(io.NewSectionReader(ra, off, n), p)
+	reqCtx := policy.WithRetryOptions(ctx, policy.RetryOptions{MaxRetries: -1})
+	for attempt := 1; ; attempt++ {
+		if err := c.opt.TransferScheduler.acquire(ctx); err != nil {
+			return err
+		}
+		start := time.Now()
+		if _, err := pr.Seek(0, io.SeekStart); err != nil {
+			c.opt.TransferScheduler.release()
+			return errors.WithStack(err)
+		}
+		_, err := client.StageBlock(reqCtx, id, streaming.NopCloser(newRateLimitReader(ctx, pr, c.rateLimiters())), nil)
+		c.opt.TransferScheduler.release()
+		if err == nil {
+			log.Debug("uploaded block", "operation", "upload", "block", id, rangeAttr(off, n), "bytes", n, "duration", time.Since(start))
+			p.chunk()
+			return nil
+		}
+		if attempt >= stageBlockAttempts || ctx.Err() != nil || !retryableBlockError(err) {
+			return errors.Wrapf(err, "failed to upload block at offset %d after %d attempts", off, attempt)
+		}
+		p.retry()
+		log.Warn("retrying block", "operation", "upload", "block", id, rangeAttr(off, n), "attempt", attempt, errAttr(err))
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(time.Duration(attempt) * stageBlockRetryDelay):
+		}
+	}
+}
+
+// retryableBlockError returns false for client errors other than timeouts
+// and throttling
+func retryableBlockError(err error) bool {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return true
+	}
+	switch respErr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return respErr.StatusCode < 400 || respErr.StatusCode >= 500
+}
+
+// azureSource reads entry data from an Azure blob
+type azureSource Entry
+
+func (ce *azureSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(&bytes.Reader{}), nil
+	}
+	rng := blob.HTTPRange{Offset: offset}
+	if length > 0 {
+		rng.Count = length
+	}
+	var rc io.ReadCloser
+	err := ce.do(ctx, func(client *blockblob.Client) error {
+		resp, err := client.DownloadStream(ctx, &blob.DownloadStreamOptions{
+			Range: rng,
+		})
+		if err != nil {
+			return err
+		}
+		rc = resp.Body
+		return nil
+	})
+	return rc, err
+}
+
+func (ce *azureSource) Size(ctx context.Context) (int64, error) {
+	var size int64
+	err := ce.do(ctx, func(client *blockblob.Client) error {
+		resp, err := client.GetProperties(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if resp.ContentLength == nil {
+			return errors.Errorf("missing content length for blob")
+		}
+		size = *resp.ContentLength
+		return nil
+	})
+	return size, err
+}
+
+// do calls f with a client for the blob. If the signed URL has expired, it
+// is reloaded and f is called again.
+func (ce *azureSource) do(ctx context.Context, f func(*blockblob.Client) error) error {
+	var retried bool
+	for {
+		ce.mu.Lock()
+		u := ce.URL
+		ce.mu.Unlock()
+		client, err := blockblob.NewClientWithNoCredential(u, azureOptions)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := f(client); err != nil {
+			if !retried && ce.reload != nil {
+				// the URL might have expired, so we try to load it again
+				retried = true
+				var respErr *azcore.ResponseError
+				if errors.As(err, &respErr) {
+					if respErr.StatusCode == http.StatusForbidden || respErr.StatusCode == http.StatusUnauthorized {
+						(*Entry)(ce).log().Warn("reloading download URL", "status", respErr.StatusCode, errAttr(err))
+						ce.mu.Lock()
+						err := ce.reload(ctx)
+						ce.mu.Unlock()
+						if err != nil {
+							return errors.WithStack(err)
 						}
+						continue // retry with the new URL
 					}
 				}
-				return nil, errors.WithStack(err)
 			}
-			return resp.Body, nil
+			return errors.WithStack(err)
 		}
-	})
+		return nil
+	}
 }
 
-func (c *Cache) commitV2(ctx context.Context, key string, size int64) error {
+func (c *Cache) commitV2(ctx context.Context, key, version string, size int64) error {
 	var payload = struct {
 		Key       string `json:"key"`
 		SizeBytes int64  `json:"size_bytes"`
@@ -116,7 +290,7 @@ func (c *Cache) commitV2(ctx context.Context, key string, size int64) error {
 	}{
 		Key:       key,
 		SizeBytes: size,
-		Version:   version(key),
+		Version:   version,
 	}
 
 	dt, err := json.Marshal(payload)
@@ -127,8 +301,7 @@ func (c *Cache) commitV2(ctx context.Context, key string, size int64) error {
 	req := c.newRequestV2(c.urlV2("FinalizeCacheEntryUpload"), func() io.Reader {
 		return bytes.NewReader(dt)
 	})
-
-	Log("commit cache req %s body=%s", req.url, dt)
+	req.idempotent = true
 
 	resp, err := c.doWithRetries(ctx, req)
 	if err != nil {
@@ -152,11 +325,11 @@ func (c *Cache) commitV2(ctx context.Context, key string, size int64) error {
 		return errors.New("failed to commit cache")
 	}
 
-	Log("commit cache resp %s %s", req.url, cr.EntryID)
+	c.log().Debug("committed cache", "operation", "commit", "key", key, "cache_id", cr.EntryID, "bytes", size)
 	return nil
 }
 
-func (c *Cache) loadV2(ctx context.Context, keys ...string) (*Entry, error) {
+func (c *Cache) loadV2(ctx context.Context, version string, keys ...string) (*Entry, error) {
 	var payload = struct {
 		Key         string   `json:"key"`
 		RestoreKeys []string `json:"restore_keys"`
@@ -164,7 +337,7 @@ func (c *Cache) loadV2(ctx context.Context, keys ...string) (*Entry, error) {
 	}{
 		Key:         keys[0],
 		RestoreKeys: keys,
-		Version:     version(keys[0]),
+		Version:     version,
 	}
 	dt, err := json.Marshal(payload)
 	if err != nil {
@@ -174,6 +347,7 @@ func (c *Cache) loadV2(ctx context.Context, keys ...string) (*Entry, error) {
 	req := c.newRequestV2(c.urlV2("GetCacheEntryDownloadURL"), func() io.Reader {
 		return bytes.NewReader(dt)
 	})
+	req.idempotent = true
 
 	resp, err := c.doWithRetries(ctx, req)
 	if err != nil {
@@ -206,18 +380,37 @@ func (c *Cache) loadV2(ctx context.Context, keys ...string) (*Entry, error) {
 	ce.IsAzureBlob = true
 	ce.client = c.opt.Client
 	ce.reload = func(ctx context.Context) error {
-		v, err := c.loadV2(ctx, keys...)
+		// only the same entry can be reloaded, a different one would not
+		// match the data already read. The lookup is done with the same
+		// version. The response does not report the scope, so an entry with
+		// the same key in another scope is told apart by its blob.
+		v, err := c.loadV2(ctx, version, ce.Key)
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		if v == nil || v.Key != ce.Key || !sameBlob(v.URL, ce.URL) {
+			return errors.Errorf("cache entry %s no longer exists", ce.Key)
+		}
 		ce.URL = v.URL
-		ce.Key = v.Key
 		return nil
 	}
 
 	return &ce, nil
 }
 
+// sameBlob reports whether the signed URLs a and b point to the same blob.
+func sameBlob(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host && ua.Path == ub.Path
+}
+
 func (c *Cache) newRequestV2(url string, body func() io.Reader) *request {
 	return &request{
 		method: "POST",
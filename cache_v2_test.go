@@ -0,0 +1,51 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStageBlockAttempts(t *testing.T) {
+	old := stageBlockRetryDelay
+	stageBlockRetryDelay = time.Millisecond
+	defer func() {
+		stageBlockRetryDelay = old
+	}()
+
+	var requests atomic.Int32
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	client, err := blockblob.NewClientWithNoCredential(srv.URL+"/blob/1?sig=foo", azureOptions)
+	require.NoError(t, err)
+	c := &Cache{opt: optsWithDefaults(Opt{})}
+	data := bytes.NewReader([]byte("foobar"))
+
+	// the azure pipeline does not retry on top of the attempts of stageBlock
+	err = c.stageBlock(context.TODO(), client, "YmxvY2s=", data, 0, 6)
+	require.ErrorContains(t, err, "after 5 attempts")
+	require.Equal(t, int32(stageBlockAttempts), requests.Load())
+
+	requests.Store(0)
+	status = http.StatusForbidden
+	err = c.stageBlock(context.TODO(), client, "YmxvY2s=", data, 0, 6)
+	require.ErrorContains(t, err, "after 1 attempts")
+	require.Equal(t, int32(1), requests.Load())
+
+	requests.Store(0)
+	status = http.StatusCreated
+	require.NoError(t, c.stageBlock(context.TODO(), client, "YmxvY2s=", data, 0, 6))
+	require.Equal(t, int32(1), requests.Load())
+}
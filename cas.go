@@ -0,0 +1,151 @@
+package actionscache
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+const casConcurrency = 8
+
+// CAS is a content addressable store on top of Cache. Data is stored under a
+// key derived from its SHA-256 digest in the "sha256:<hex>" format. Because
+// the key identifies the data, saves of the same data from concurrent
+// writers are not conflicts.
+type CAS struct {
+	c      *Cache
+	prefix string
+}
+
+// NewCAS returns a CAS that stores data in c. The prefix is added to the keys
+// of the entries.
+func NewCAS(c *Cache, prefix string) *CAS {
+	return &CAS{c: c, prefix: prefix}
+}
+
+func validateDigest(dgst string) error {
+	hx, ok := strings.CutPrefix(dgst, "sha256:")
+	if !ok || len(hx) != 64 {
+		return errors.Errorf("invalid digest %q", dgst)
+	}
+	if _, err := hex.DecodeString(hx); err != nil {
+		return errors.Errorf("invalid digest %q", dgst)
+	}
+	return nil
+}
+
+func (s *CAS) key(dgst string) string {
+	return s.prefix + dgst
+}
+
+func (s *CAS) load(ctx context.Context, dgst string) (*Entry, error) {
+	if err := validateDigest(dgst); err != nil {
+		return nil, err
+	}
+	key := s.key(dgst)
+	if b, ok := s.c.backend.(ExactLookupBackend); ok {
+		return s.c.loadExact(ctx, b, key)
+	}
+	ce, err := s.c.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if ce == nil {
+		return nil, nil
+	}
+	// the service matches keys as prefixes and searches the scopes in order,
+	// so a longer key in an earlier scope hides the digest in a later one
+	if ce.Key != key {
+		s.c.log().Debug("digest hidden by longer key", "key", key, "matched_key", ce.Key)
+		return nil, nil
+	}
+	return ce, nil
+}
+
+// Has returns true if data for the digest exists in any of the scopes of the
+// cache. Only entries saved under the exact digest key match. The lookup of
+// the GitHub cache service can't skip a longer key in an earlier scope, so
+// the digest is reported as missing then and Put saves it to the writable
+// scope again.
+func (s *CAS) Has(ctx context.Context, dgst string) (bool, error) {
+	ce, err := s.load(ctx, dgst)
+	if err != nil {
+		return false, err
+	}
+	return ce != nil, nil
+}
+
+// HasMany checks the existence of multiple digests concurrently. The result
+// has the same order as dgsts.
+func (s *CAS) HasMany(ctx context.Context, dgsts ...string) ([]bool, error) {
+	out := make([]bool, len(dgsts))
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(casConcurrency)
+	for i, dgst := range dgsts {
+		eg.Go(func() error {
+			ok, err := s.Has(ctx, dgst)
+			if err != nil {
+				return errors.Wrapf(err, "failed to check %s", dgst)
+			}
+			out[i] = ok
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Get returns a reader for the data of the digest. The data is verified while
+// reading and ErrDigestMismatch is returned at the end of the data if it does
+// not match. If the digest does not exist, the error matches os.ErrNotExist.
+func (s *CAS) Get(ctx context.Context, dgst string) (io.ReadCloser, error) {
+	ce, err := s.load(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+	if ce == nil {
+		return nil, errors.Wrapf(os.ErrNotExist, "digest %s not found", dgst)
+	}
+	rc, err := ce.reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{Reader: newVerifyReader(rc, dgst, -1), Closer: rc}, nil
+}
+
+// Put stores b under the digest. The upload is skipped if the digest already
+// exists or if another writer is saving it at the same time.
+func (s *CAS) Put(ctx context.Context, dgst string, b Blob) error {
+	if err := validateDigest(dgst); err != nil {
+		return err
+	}
+	actual, err := blobDigest(b)
+	if err != nil {
+		return err
+	}
+	if actual != dgst {
+		return errors.WithStack(ErrDigestMismatch{Expected: dgst, Actual: actual})
+	}
+	ok, err := s.Has(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	if err := s.c.Save(ctx, s.key(dgst), b); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			s.c.log().Debug("digest is already being saved", "key", s.key(dgst))
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package actionscache
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCAS(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, s := newTestCache(t, v2, Opt{})
+		cas := NewCAS(c, "cas-")
+
+		foo := []byte("foo")
+		bar := []byte("bar")
+		dgstFoo := fmt.Sprintf("sha256:%x", sha256.Sum256(foo))
+		dgstBar := fmt.Sprintf("sha256:%x", sha256.Sum256(bar))
+
+		ok, err := cas.Has(ctx, dgstFoo)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		_, err = cas.Get(ctx, dgstFoo)
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		require.NoError(t, cas.Put(ctx, dgstFoo, NewBlob(foo)))
+		require.NoError(t, cas.Put(ctx, dgstFoo, NewBlob(foo)))
+		require.Equal(t, []string{"cas-" + dgstFoo}, s.Keys())
+
+		var dm ErrDigestMismatch
+		err = cas.Put(ctx, dgstBar, NewBlob(foo))
+		require.True(t, errors.As(err, &dm))
+
+		_, err = cas.Has(ctx, "sha256:foo")
+		require.ErrorContains(t, err, "invalid digest")
+
+		res, err := cas.HasMany(ctx, dgstBar, dgstFoo)
+		require.NoError(t, err)
+		require.Equal(t, []bool{false, true}, res)
+
+		rc, err := cas.Get(ctx, dgstFoo)
+		require.NoError(t, err)
+		dt, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.Equal(t, foo, dt)
+		require.NoError(t, rc.Close())
+
+		// key reserved by a concurrent writer
+		s.mu.Lock()
+		e := s.reserve("cas-"+dgstBar, s.entries[0].version)
+		s.mu.Unlock()
+		require.NotNil(t, e)
+		require.NoError(t, cas.Put(ctx, dgstBar, NewBlob(bar)))
+
+		s.mu.Lock()
+		for _, e := range s.entries {
+			if e.committed {
+				e.data[0] ^= 0xff
+			}
+		}
+		s.mu.Unlock()
+		rc, err = cas.Get(ctx, dgstFoo)
+		require.NoError(t, err)
+		_, err = io.ReadAll(rc)
+		require.True(t, errors.As(err, &dm))
+		require.NoError(t, rc.Close())
+	})
+}
+
+// scopedBackend searches the scopes in order like the cache service. Entries
+// are saved to the first scope.
+type scopedBackend struct {
+	scopes []*LocalBackend
+}
+
+func (b *scopedBackend) Lookup(ctx context.Context, keys ...string) (*Entry, error) {
+	for _, s := range b.scopes {
+		if ce, err := s.Lookup(ctx, keys...); err != nil || ce != nil {
+			return ce, err
+		}
+	}
+	return nil, nil
+}
+
+func (b *scopedBackend) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return b.scopes[0].Reserve(ctx, key)
+}
+
+func (b *scopedBackend) Upload(ctx context.Context, r *Reservation, blob Blob) error {
+	return b.scopes[0].Upload(ctx, r, blob)
+}
+
+func (b *scopedBackend) Commit(ctx context.Context, r *Reservation, size int64) error {
+	return b.scopes[0].Commit(ctx, r, size)
+}
+
+// exactScopedBackend can also look up keys without prefix matching
+type exactScopedBackend struct {
+	scopedBackend
+}
+
+func (b *exactScopedBackend) LookupExact(ctx context.Context, version, key string) (*Entry, error) {
+	for _, s := range b.scopes {
+		if ce, err := s.LookupExact(ctx, version, key); err != nil || ce != nil {
+			return ce, err
+		}
+	}
+	return nil, nil
+}
+
+// newHiddenDigest returns a pull request scope with a longer key for the
+// digest of data and a main scope with the digest
+func newHiddenDigest(t *testing.T, data []byte) (string, []*LocalBackend) {
+	ctx := context.TODO()
+	dgst := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	pr, err := NewLocalBackend(t.TempDir())
+	require.NoError(t, err)
+	main, err := NewLocalBackend(t.TempDir())
+	require.NoError(t, err)
+	c, err := NewWithBackend(main, Opt{})
+	require.NoError(t, err)
+	require.NoError(t, NewCAS(c, "cas-").Put(ctx, dgst, NewBlob(data)))
+	c, err = NewWithBackend(pr, Opt{})
+	require.NoError(t, err)
+	require.NoError(t, c.Save(ctx, "cas-"+dgst+"-other", NewBlob([]byte("bar"))))
+	return dgst, []*LocalBackend{pr, main}
+}
+
+func TestCASExactLookup(t *testing.T) {
+	ctx := context.TODO()
+	foo := []byte("foo")
+	dgst, scopes := newHiddenDigest(t, foo)
+
+	// the longer key in the first scope does not hide the digest
+	c, err := NewWithBackend(&exactScopedBackend{scopedBackend{scopes}}, Opt{})
+	require.NoError(t, err)
+	cas := NewCAS(c, "cas-")
+	ok, err := cas.Has(ctx, dgst)
+	require.NoError(t, err)
+	require.True(t, ok)
+	rc, err := cas.Get(ctx, dgst)
+	require.NoError(t, err)
+	dt, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, foo, dt)
+	require.NoError(t, rc.Close())
+}
+
+func TestCASHiddenDigest(t *testing.T) {
+	ctx := context.TODO()
+	foo := []byte("foo")
+	dgst, scopes := newHiddenDigest(t, foo)
+
+	// without exact lookups the longer key can't be skipped, so the digest is
+	// saved again where it takes precedence
+	c, err := NewWithBackend(&scopedBackend{scopes}, Opt{})
+	require.NoError(t, err)
+	cas := NewCAS(c, "cas-")
+	ok, err := cas.Has(ctx, dgst)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, cas.Put(ctx, dgst, NewBlob(foo)))
+	ok, err = cas.Has(ctx, dgst)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
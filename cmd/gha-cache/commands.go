@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+	"github.com/tonistiigi/go-actions-cache/archive"
+)
+
+type saveResult struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size,omitempty"`
+}
+
+type restoreResult struct {
+	Key string `json:"key"`
+	Hit bool   `json:"hit"`
+}
+
+type pruneResult struct {
+	Deleted []actionscache.CacheKey `json:"deleted"`
+	DryRun  bool                    `json:"dry_run"`
+}
+
+type tokenInfo struct {
+	URL       string      `json:"url"`
+	API       string      `json:"api"`
+	IssuedAt  time.Time   `json:"issued_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	Scopes    []scopeInfo `json:"scopes"`
+}
+
+type scopeInfo struct {
+	Scope      string `json:"scope"`
+	Permission string `json:"permission"`
+}
+
+// archiveFlags are the flags of save and restore for directories saved in
+// the format of the actions/cache action
+type archiveFlags struct {
+	paths       stringsFlag
+	compression string
+	crossOS     bool
+	workspace   string
+}
+
+func (a *archiveFlags) register(fs *flag.FlagSet) {
+	fs.Var(&a.paths, "path", "Path like the path input of actions/cache, can be repeated")
+	fs.StringVar(&a.compression, "compression", "", "Compression of saved paths: zstd, zstd-without-long or gzip")
+	fs.BoolVar(&a.crossOS, "cross-os", false, "Share saved paths between Windows and other platforms")
+	fs.StringVar(&a.workspace, "workspace", "", "Directory paths are relative to, defaults to $GITHUB_WORKSPACE")
+}
+
+func (a *archiveFlags) opt() archive.Opt {
+	return archive.Opt{
+		Compression: actionscache.ToolkitCompression(a.compression),
+		CrossOS:     a.crossOS,
+		Workspace:   a.workspace,
+		Paths:       a.paths,
+	}
+}
+
+func runSave(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) error {
+	var af archiveFlags
+	af.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 || (len(af.paths) > 0 && fs.NArg() != 1) {
+		fs.Usage()
+		return errors.New("save requires a key and a file or paths")
+	}
+	key := fs.Arg(0)
+	cache, err := c.cache()
+	if err != nil {
+		return err
+	}
+
+	res := saveResult{Key: key}
+	if len(af.paths) > 0 {
+		if err := archive.SaveDirs(ctx, cache, key, af.paths, af.opt()); err != nil {
+			return err
+		}
+	} else {
+		b, err := c.openBlob(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer b.Close()
+		if err := cache.Save(ctx, key, b); err != nil {
+			return err
+		}
+		res.Size = b.Size()
+	}
+	return c.print(res, func(w io.Writer) error {
+		if res.Size > 0 {
+			_, err := fmt.Fprintf(w, "saved %s (%s)\n", key, formatSize(res.Size))
+			return err
+		}
+		_, err := fmt.Fprintf(w, "saved %s\n", key)
+		return err
+	})
+}
+
+// openBlob opens the file to save. Stdin is buffered in a temporary file as
+// uploads need random access.
+func (c *cli) openBlob(p string) (*actionscache.FileBlob, error) {
+	if p != "" && p != "-" {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		b, err := actionscache.NewFileBlob(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return b, nil
+	}
+	b, err := actionscache.CreateTempBlob("", "gha-cache-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(b, c.stdin); err != nil {
+		b.Close()
+		return nil, errors.Wrap(err, "failed to read stdin")
+	}
+	if err := b.UpdateSize(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func runRestore(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) error {
+	var af archiveFlags
+	af.register(fs)
+	out := fs.String("o", "", "File to write the entry to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || (len(af.paths) == 0) == (*out == "") {
+		fs.Usage()
+		return errors.New("restore requires keys and either -o or -path")
+	}
+	cache, err := c.cache()
+	if err != nil {
+		return err
+	}
+
+	var res restoreResult
+	if len(af.paths) > 0 {
+		dest := af.workspace
+		if dest == "" {
+			dest = os.Getenv("GITHUB_WORKSPACE")
+		}
+		if dest == "" {
+			dest = "."
+		}
+		key, err := archive.RestoreDirs(ctx, cache, fs.Args(), dest, af.opt())
+		if err != nil {
+			return err
+		}
+		res = restoreResult{Key: key, Hit: key != ""}
+	} else {
+		ce, err := cache.Load(ctx, fs.Args()...)
+		if err != nil {
+			return err
+		}
+		if ce != nil {
+			if err := downloadFile(ctx, ce, *out); err != nil {
+				return err
+			}
+			res = restoreResult{Key: ce.Key, Hit: true}
+		}
+	}
+
+	if err := c.print(res, func(w io.Writer) error {
+		if !res.Hit {
+			_, err := fmt.Fprintf(w, "no cache found for keys %v\n", fs.Args())
+			return err
+		}
+		_, err := fmt.Fprintf(w, "restored %s\n", res.Key)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !res.Hit {
+		return errMiss
+	}
+	return nil
+}
+
+// downloadFile writes the entry to p. A partial file is removed on error.
+func downloadFile(ctx context.Context, ce *actionscache.Entry, p string) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := ce.DownloadTo(ctx, f, actionscache.DownloadOpt{}); err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+	return errors.WithStack(f.Close())
+}
+
+func runCat(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("cat requires keys")
+	}
+	cache, err := c.cache()
+	if err != nil {
+		return err
+	}
+	ce, err := cache.Load(ctx, fs.Args()...)
+	if err != nil {
+		return err
+	}
+	if ce == nil {
+		fmt.Fprintf(c.stderr, "no cache found for keys %v\n", fs.Args())
+		return errMiss
+	}
+	return ce.WriteTo(ctx, c.stdout)
+}
+
+func runList(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) error {
+	prefix := fs.String("prefix", "", "Only list keys with the prefix")
+	ref := fs.String("ref", "", "Only list caches of the Git ref, e.g. refs/heads/main")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("list takes no arguments")
+	}
+	api, err := c.api()
+	if err != nil {
+		return err
+	}
+	keys, err := api.ListKeys(ctx, *prefix, *ref)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		keys = []actionscache.CacheKey{}
+	}
+	return c.print(keys, func(w io.Writer) error {
+		return printKeys(w, keys)
+	})
+}
+
+func printKeys(w io.Writer, keys []actionscache.CacheKey) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tKEY\tREF\tSIZE\tLAST USED")
+	for _, k := range keys {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", k.ID, k.Key, k.Ref, formatSize(int64(k.SizeInBytes)), formatTime(k.LastAccessed))
+	}
+	return errors.WithStack(tw.Flush())
+}
+
+func runDelete(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) error {
+	ref := fs.String("ref", "", "Only delete caches of the Git ref")
+	id := fs.Int("id", 0, "Delete the cache with the ID instead of a key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*id == 0) == (fs.NArg() == 0) || fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("delete requires a key or -id")
+	}
+	api, err := c.api()
+	if err != nil {
+		return err
+	}
+	var res *actionscache.DeleteResult
+	if *id != 0 {
+		res, err = api.DeleteByID(ctx, *id)
+	} else {
+		res, err = api.DeleteByKey(ctx, fs.Arg(0), *ref)
+	}
+	if err != nil {
+		return err
+	}
+	return c.print(res, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "deleted %d caches\n", res.Deleted)
+		return err
+	})
+}
+
+func runPrune(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) error {
+	prefix := fs.String("prefix", "", "Only prune keys with the prefix")
+	ref := fs.String("ref", "", "Only prune caches of the Git ref")
+	olderThan := fs.Duration("older-than", 0, "Delete caches not used for the duration")
+	keep := fs.Int("keep", -1, "Delete all but the most recently used caches")
+	dryRun := fs.Bool("dry-run", false, "Only print the caches that would be deleted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("prune takes no arguments")
+	}
+	if *olderThan <= 0 && *keep < 0 {
+		fs.Usage()
+		return errors.New("prune requires -older-than or -keep")
+	}
+	api, err := c.api()
+	if err != nil {
+		return err
+	}
+	keys, err := api.ListKeys(ctx, *prefix, *ref)
+	if err != nil {
+		return err
+	}
+
+	res := pruneResult{Deleted: pruneCandidates(keys, *olderThan, *keep, time.Now()), DryRun: *dryRun}
+	if !*dryRun {
+		for _, k := range res.Deleted {
+			if _, err := api.DeleteByID(ctx, k.ID); err != nil {
+				return errors.Wrapf(err, "failed to delete %s (%d)", k.Key, k.ID)
+			}
+		}
+	}
+	return c.print(res, func(w io.Writer) error {
+		if len(res.Deleted) > 0 {
+			if err := printKeys(w, res.Deleted); err != nil {
+				return err
+			}
+		}
+		verb := "deleted"
+		if res.DryRun {
+			verb = "would delete"
+		}
+		_, err := fmt.Fprintf(w, "%s %d of %d caches\n", verb, len(res.Deleted), len(keys))
+		return err
+	})
+}
+
+// pruneCandidates returns the keys that were not used in the last olderThan or
+// are not among the keep most recently used ones. Negative or zero values
+// disable the conditions.
+func pruneCandidates(keys []actionscache.CacheKey, olderThan time.Duration, keep int, now time.Time) []actionscache.CacheKey {
+	keys = append([]actionscache.CacheKey{}, keys...)
+	lastUsed := func(k actionscache.CacheKey) time.Time {
+		t, _ := time.Parse(time.RFC3339, k.LastAccessed)
+		return t
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return lastUsed(keys[i]).After(lastUsed(keys[j]))
+	})
+	out := []actionscache.CacheKey{}
+	for i, k := range keys {
+		if (keep >= 0 && i >= keep) || (olderThan > 0 && now.Sub(lastUsed(k)) > olderThan) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func runInspectToken(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("inspect-token takes no arguments")
+	}
+	cache, err := c.cache()
+	if err != nil {
+		return err
+	}
+	info := tokenInfo{
+		URL:       cache.URL,
+		API:       "v1",
+		IssuedAt:  cache.IssuedAt,
+		ExpiresAt: cache.ExpiresAt,
+		Scopes:    []scopeInfo{},
+	}
+	if cache.IsV2 {
+		info.API = "v2"
+	}
+	for _, s := range cache.Scopes() {
+		info.Scopes = append(info.Scopes, scopeInfo{Scope: s.Scope, Permission: s.Permission.String()})
+	}
+	return c.print(info, func(w io.Writer) error {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "URL:\t%s\n", info.URL)
+		fmt.Fprintf(tw, "API:\t%s\n", info.API)
+		fmt.Fprintf(tw, "Issued:\t%s\n", info.IssuedAt.Local().Format(time.DateTime))
+		fmt.Fprintf(tw, "Expires:\t%s (in %s)\n", info.ExpiresAt.Local().Format(time.DateTime), time.Until(info.ExpiresAt).Round(time.Second))
+		for _, s := range info.Scopes {
+			fmt.Fprintf(tw, "Scope:\t%s (%s)\n", s.Scope, s.Permission)
+		}
+		return errors.WithStack(tw.Flush())
+	})
+}
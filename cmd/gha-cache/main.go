@@ -0,0 +1,192 @@
+// Command gha-cache reads and manages the GitHub Actions cache from shell
+// steps of a workflow.
+//
+// Cache access is configured from the same environment variables as
+// actionscache.TryEnv, management commands use GITHUB_TOKEN and
+// GITHUB_REPOSITORY like actionscache.TryEnvRestAPI.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+)
+
+// errMiss is returned when no entry matched the keys. The command exits with
+// status 2 so that scripts can tell misses from errors.
+var errMiss = errors.New("cache miss")
+
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	json    bool
+	version string
+	opt     actionscache.Opt
+}
+
+type command struct {
+	name  string
+	args  string
+	short string
+	run   func(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"save", "[flags] KEY [FILE]", "Save a file, stdin or paths under a key", runSave},
+	{"restore", "[flags] KEY...", "Restore the first entry matching the keys", runRestore},
+	{"cat", "KEY...", "Write the first entry matching the keys to stdout", runCat},
+	{"list", "[flags]", "List the caches of the repository", runList},
+	{"delete", "[flags] [KEY]", "Delete caches by key or ID", runDelete},
+	{"prune", "[flags]", "Delete old or least recently used caches", runPrune},
+	{"inspect-token", "", "Show the URL and scopes of the runtime token", runInspectToken},
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	cancel()
+	switch {
+	case err == nil:
+	case errors.Is(err, errMiss):
+		os.Exit(2)
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(2)
+	default:
+		fmt.Fprintf(os.Stderr, "gha-cache: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+
+	fs := flag.NewFlagSet("gha-cache", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&c.json, "json", false, "Print output as JSON")
+	fs.StringVar(&c.version, "cache-version", "", "Version of the cache entries")
+	fs.DurationVar(&c.opt.Timeout, "timeout", 0, "Timeout of retried requests")
+	debug := fs.Bool("debug", false, "Log requests to stderr")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: gha-cache [flags] COMMAND [ARGS]\n\nCommands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(stderr, "  %-14s %s\n", cmd.name, cmd.short)
+		}
+		fmt.Fprintf(stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(stderr, "\nrestore and cat exit with status 2 on a cache miss.\n")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *debug {
+		c.opt.Logger = slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	name := fs.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(ctx, c, c.flags(cmd), fs.Args()[1:])
+		}
+	}
+	fs.Usage()
+	return errors.Errorf("unknown command %q", name)
+}
+
+// flags returns the flag set of a command
+func (c *cli) flags(cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "Usage: gha-cache %s %s\n\n%s\n", cmd.name, cmd.args, cmd.short)
+		var hasFlags bool
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(c.stderr, "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+func (c *cli) cache() (*actionscache.Cache, error) {
+	cache, err := actionscache.TryEnv(c.opt)
+	if err != nil {
+		return nil, err
+	}
+	if cache == nil {
+		return nil, errors.New("no cache token found, ACTIONS_RUNTIME_TOKEN needs to be set")
+	}
+	if c.version != "" {
+		cache = cache.WithVersion(c.version)
+	}
+	return cache, nil
+}
+
+func (c *cli) api() (*actionscache.RestAPI, error) {
+	api, err := actionscache.TryEnvRestAPI(c.opt)
+	if err != nil {
+		return nil, err
+	}
+	if api == nil {
+		return nil, errors.New("GITHUB_TOKEN and GITHUB_REPOSITORY need to be set")
+	}
+	return api, nil
+}
+
+// print writes v as JSON if requested, otherwise the text output.
+func (c *cli) print(v interface{}, text func(w io.Writer) error) error {
+	if c.json {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(v))
+	}
+	return text(c.stdout)
+}
+
+// stringsFlag is a flag that can be repeated
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatTime(v string) string {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return v
+	}
+	return t.Local().Format(time.DateTime)
+}
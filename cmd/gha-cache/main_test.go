@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	actionscache "github.com/tonistiigi/go-actions-cache"
+	"github.com/tonistiigi/go-actions-cache/actionscachetest"
+)
+
+func setupEnv(t *testing.T, v2 bool) *actionscachetest.Server {
+	s := actionscachetest.NewServer()
+	t.Cleanup(s.Close)
+	token, err := s.Token()
+	require.NoError(t, err)
+
+	t.Setenv("GHCACHE_TOKEN_ENC", "")
+	os.Unsetenv("GHCACHE_TOKEN_ENC")
+	t.Setenv("ACTIONS_CACHE_API_FORCE_VERSION", "")
+	t.Setenv("ACTIONS_RUNTIME_TOKEN", token)
+	t.Setenv("ACTIONS_CACHE_URL", s.URL)
+	t.Setenv("ACTIONS_RESULTS_URL", s.URL)
+	t.Setenv("ACTIONS_CACHE_SERVICE_V2", "false")
+	if v2 {
+		t.Setenv("ACTIONS_CACHE_SERVICE_V2", "true")
+	}
+	t.Setenv("GITHUB_TOKEN", "token")
+	t.Setenv("GITHUB_REPOSITORY", "owner/repo")
+	t.Setenv("GITHUB_API_URL", s.URL)
+	t.Setenv("GITHUB_WORKSPACE", "")
+	return s
+}
+
+func runCmd(t *testing.T, stdin string, args ...string) (string, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	err := run(context.TODO(), args, strings.NewReader(stdin), stdout, stderr)
+	return stdout.String(), err
+}
+
+func TestSaveRestore(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		name := "v1"
+		if v2 {
+			name = "v2"
+		}
+		t.Run(name, func(t *testing.T) {
+			s := setupEnv(t, v2)
+			dir := t.TempDir()
+
+			p := filepath.Join(dir, "in")
+			require.NoError(t, os.WriteFile(p, []byte("from file"), 0644))
+			out, err := runCmd(t, "", "save", "file-1", p)
+			require.NoError(t, err)
+			require.Equal(t, "saved file-1 (9B)\n", out)
+
+			out, err = runCmd(t, "from stdin", "-json", "save", "stdin-1")
+			require.NoError(t, err)
+			var sr saveResult
+			require.NoError(t, json.Unmarshal([]byte(out), &sr))
+			require.Equal(t, saveResult{Key: "stdin-1", Size: 10}, sr)
+			require.Equal(t, []string{"file-1", "stdin-1"}, s.Keys())
+
+			out, err = runCmd(t, "", "cat", "missing-", "stdin-")
+			require.NoError(t, err)
+			require.Equal(t, "from stdin", out)
+
+			_, err = runCmd(t, "", "cat", "missing-")
+			require.ErrorIs(t, err, errMiss)
+
+			dest := filepath.Join(dir, "out")
+			out, err = runCmd(t, "", "-json", "restore", "-o", dest, "file-")
+			require.NoError(t, err)
+			var rr restoreResult
+			require.NoError(t, json.Unmarshal([]byte(out), &rr))
+			require.Equal(t, restoreResult{Key: "file-1", Hit: true}, rr)
+			dt, err := os.ReadFile(dest)
+			require.NoError(t, err)
+			require.Equal(t, "from file", string(dt))
+
+			out, err = runCmd(t, "", "-json", "restore", "-o", filepath.Join(dir, "miss"), "missing-")
+			require.ErrorIs(t, err, errMiss)
+			require.NoError(t, json.Unmarshal([]byte(out), &rr))
+			require.Equal(t, restoreResult{}, rr)
+			_, err = os.Stat(filepath.Join(dir, "miss"))
+			require.ErrorIs(t, err, os.ErrNotExist)
+
+			// entries are namespaced by version
+			_, err = runCmd(t, "", "-cache-version", "other", "cat", "file-1")
+			require.ErrorIs(t, err, errMiss)
+		})
+	}
+}
+
+func TestSaveRestorePaths(t *testing.T) {
+	setupEnv(t, true)
+	ws := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(ws, "deps"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "deps", "a"), []byte("a"), 0644))
+
+	out, err := runCmd(t, "", "save", "-workspace", ws, "-path", "deps", "deps-1")
+	require.NoError(t, err)
+	require.Equal(t, "saved deps-1\n", out)
+
+	// without paths the version does not match
+	_, err = runCmd(t, "", "cat", "deps-1")
+	require.ErrorIs(t, err, errMiss)
+
+	dest := t.TempDir()
+	out, err = runCmd(t, "", "restore", "-workspace", dest, "-path", "deps", "deps-")
+	require.NoError(t, err)
+	require.Equal(t, "restored deps-1\n", out)
+	dt, err := os.ReadFile(filepath.Join(dest, "deps", "a"))
+	require.NoError(t, err)
+	require.Equal(t, "a", string(dt))
+
+	_, err = runCmd(t, "", "restore", "-o", "x", "-path", "deps", "deps-")
+	require.Error(t, err)
+}
+
+func TestManage(t *testing.T) {
+	setupEnv(t, false)
+	for _, k := range []string{"build-1", "build-2", "build-3", "other"} {
+		_, err := runCmd(t, k, "save", k)
+		require.NoError(t, err)
+	}
+
+	out, err := runCmd(t, "", "list", "-prefix", "build-")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 4)
+	require.True(t, strings.HasPrefix(lines[0], "ID"))
+
+	out, err = runCmd(t, "", "-json", "list")
+	require.NoError(t, err)
+	var keys []actionscache.CacheKey
+	require.NoError(t, json.Unmarshal([]byte(out), &keys))
+	require.Len(t, keys, 4)
+
+	out, err = runCmd(t, "", "-json", "delete", "other")
+	require.NoError(t, err)
+	var dr actionscache.DeleteResult
+	require.NoError(t, json.Unmarshal([]byte(out), &dr))
+	require.Equal(t, 1, dr.Deleted)
+
+	out, err = runCmd(t, "", "-json", "prune", "-prefix", "build-", "-keep", "1", "-dry-run")
+	require.NoError(t, err)
+	var pr pruneResult
+	require.NoError(t, json.Unmarshal([]byte(out), &pr))
+	require.True(t, pr.DryRun)
+	require.Len(t, pr.Deleted, 2)
+
+	out, err = runCmd(t, "", "prune", "-prefix", "build-", "-keep", "1")
+	require.NoError(t, err)
+	require.Contains(t, out, "deleted 2 of 3 caches")
+
+	out, err = runCmd(t, "", "-json", "list")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(out), &keys))
+	require.Len(t, keys, 1)
+
+	_, err = runCmd(t, "", "prune")
+	require.Error(t, err)
+}
+
+func TestInspectToken(t *testing.T) {
+	s := setupEnv(t, true)
+	out, err := runCmd(t, "", "-json", "inspect-token")
+	require.NoError(t, err)
+	var info tokenInfo
+	require.NoError(t, json.Unmarshal([]byte(out), &info))
+	require.Equal(t, s.URL, info.URL)
+	require.Equal(t, "v2", info.API)
+	require.True(t, info.ExpiresAt.After(time.Now()))
+	require.NotEmpty(t, info.Scopes)
+
+	out, err = runCmd(t, "", "inspect-token")
+	require.NoError(t, err)
+	require.Contains(t, out, "Scope:")
+
+	t.Setenv("ACTIONS_RUNTIME_TOKEN", "")
+	_, err = runCmd(t, "", "inspect-token")
+	require.Error(t, err)
+}
+
+func TestPruneCandidates(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	key := func(id int, daysAgo int) actionscache.CacheKey {
+		return actionscache.CacheKey{ID: id, LastAccessed: now.AddDate(0, 0, -daysAgo).Format(time.RFC3339)}
+	}
+	keys := []actionscache.CacheKey{key(1, 5), key(2, 1), key(3, 3), key(4, 8)}
+
+	ids := func(keys []actionscache.CacheKey) []int {
+		out := []int{}
+		for _, k := range keys {
+			out = append(out, k.ID)
+		}
+		return out
+	}
+	require.Equal(t, []int{1, 4}, ids(pruneCandidates(keys, 4*24*time.Hour, -1, now)))
+	require.Equal(t, []int{3, 1, 4}, ids(pruneCandidates(keys, 0, 1, now)))
+	require.Equal(t, []int{1, 4}, ids(pruneCandidates(keys, 6*24*time.Hour, 2, now)))
+	require.Equal(t, []int{}, ids(pruneCandidates(keys, 0, 10, now)))
+}
@@ -0,0 +1,140 @@
+package actionscache
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Codec is a compression format for saved data
+type Codec string
+
+const (
+	CodecNone Codec = ""
+	CodecZstd Codec = "zstd"
+	CodecGzip Codec = "gzip"
+)
+
+func (c Codec) validate() error {
+	switch c {
+	case CodecNone, CodecZstd, CodecGzip:
+		return nil
+	default:
+		return errors.Errorf("unsupported compression codec %q", c)
+	}
+}
+
+func (c Codec) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CodecZstd:
+		zw, err := zstd.NewWriter(w)
+		return zw, errors.WithStack(err)
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, c.validate()
+	}
+}
+
+func (c Codec) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CodecNone:
+		return io.NopCloser(r), nil
+	case CodecZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return zr.IOReadCloser(), nil
+	case CodecGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read gzip header")
+		}
+		return gr, nil
+	default:
+		return nil, c.validate()
+	}
+}
+
+// compress writes the compressed data of b to a temporary file. The digest of
+// the uncompressed data is returned with the blob of the compressed data.
+func compress(b Blob, codec Codec) (Blob, string, error) {
+	fb, err := CreateTempBlob("", "actionscache-")
+	if err != nil {
+		return nil, "", err
+	}
+	cw, err := codec.newWriter(fb)
+	if err != nil {
+		fb.Close()
+		return nil, "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(cw, h), io.NewSectionReader(b, 0, b.Size())); err != nil {
+		fb.Close()
+		return nil, "", errors.WithStack(err)
+	}
+	if err := cw.Close(); err != nil {
+		fb.Close()
+		return nil, "", errors.WithStack(err)
+	}
+	if err := fb.UpdateSize(); err != nil {
+		fb.Close()
+		return nil, "", err
+	}
+	return fb, "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// decompressSource provides random access to compressed data. Every Open
+// decompresses the data from the start, so sequential reads that continue on
+// the same reader are needed for good performance.
+type decompressSource struct {
+	src   EntrySource
+	codec Codec
+	size  int64
+}
+
+func (s *decompressSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	rc, err := s.src.Open(ctx, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := s.codec.newReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	c := &multiCloser{dr, rc}
+	if offset > 0 {
+		if _, err := io.CopyN(io.Discard, dr, offset); err != nil {
+			c.Close()
+			return nil, errors.Wrapf(err, "failed to seek to offset %d", offset)
+		}
+	}
+	var r io.Reader = dr
+	if length >= 0 {
+		r = io.LimitReader(dr, length)
+	}
+	return &readCloser{Reader: r, Closer: c}, nil
+}
+
+func (s *decompressSource) Size(ctx context.Context) (int64, error) {
+	return s.size, nil
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if err1 := c.Close(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	for _, codec := range []Codec{CodecZstd, CodecGzip} {
+		t.Run(string(codec), func(t *testing.T) {
+			forEachAPI(t, func(t *testing.T, v2 bool) {
+				ctx := context.TODO()
+				c, s := newTestCache(t, v2, Opt{Compression: codec, UploadChunkSize: 16})
+
+				data := bytes.Repeat([]byte("0123456789"), 1000)
+				err := c.Save(ctx, "compressed", NewBlob(data))
+				require.NoError(t, err)
+
+				s.mu.Lock()
+				stored := len(s.entries[0].data)
+				s.mu.Unlock()
+				require.Less(t, stored, len(data)/10)
+
+				// readers detect the codec without any options
+				c2, err := s.newCache(v2, Opt{})
+				require.NoError(t, err)
+				ce, err := c2.Load(ctx, "compressed")
+				require.NoError(t, err)
+				require.NotNil(t, ce)
+
+				size, err := ce.Size(ctx)
+				require.NoError(t, err)
+				require.Equal(t, int64(len(data)), size)
+
+				buf := &bytes.Buffer{}
+				require.NoError(t, ce.WriteTo(ctx, buf))
+				require.Equal(t, data, buf.Bytes())
+
+				wa := make(writerAt, len(data))
+				require.NoError(t, ce.DownloadTo(ctx, wa, DownloadOpt{ChunkSize: 7}))
+				require.Equal(t, data, []byte(wa))
+
+				rac := ce.Download(ctx)
+				dt := make([]byte, 5)
+				_, err = rac.ReadAt(dt, 5012)
+				require.NoError(t, err)
+				require.Equal(t, "23456", string(dt))
+				require.NoError(t, rac.Close())
+			})
+		})
+	}
+
+	c, _ := newTestCache(t, false, Opt{Compression: "lz4"})
+	err := c.Save(context.TODO(), "invalid", NewBlob([]byte("foo")))
+	require.ErrorContains(t, err, "unsupported compression codec")
+}
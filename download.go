@@ -0,0 +1,256 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultDownloadConcurrency = 4
+	defaultDownloadChunkSize   = 32 * 1024 * 1024
+	defaultDownloadRetries     = 3
+)
+
+// DownloadOpt configures Entry.DownloadTo. Zero values use the settings of
+// the Opt the entry was loaded with.
+type DownloadOpt struct {
+	// Concurrency is the number of ranges fetched in parallel. Defaults to
+	// Opt.DownloadConcurrency.
+	Concurrency int
+	// ChunkSize is the size of a single range request. Defaults to
+	// Opt.DownloadChunkSize.
+	ChunkSize int64
+	// Retries is how many times a failed range is retried before the download
+	// fails. Defaults to 3. Use a negative value to disable retries.
+	Retries int
+}
+
+// withDefaults fills unset values from base and then from the defaults
+func (opt DownloadOpt) withDefaults(base DownloadOpt) DownloadOpt {
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = base.Concurrency
+	}
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = defaultDownloadConcurrency
+	}
+	if opt.ChunkSize <= 0 {
+		opt.ChunkSize = base.ChunkSize
+	}
+	if opt.ChunkSize <= 0 {
+		opt.ChunkSize = defaultDownloadChunkSize
+	}
+	if opt.Retries == 0 {
+		opt.Retries = defaultDownloadRetries
+	} else if opt.Retries < 0 {
+		opt.Retries = 0
+	}
+	return opt
+}
+
+// DownloadTo downloads the entry data into w. The data is split into ranges
+// that are fetched concurrently and written to w at their offsets, so w needs
+// to allow concurrent WriteAt calls for non-overlapping ranges. Compressed and
+// encrypted entries are decoded and written in order instead. A range that
+// fails is retried from where it stopped without restarting the other ranges.
+// If a digest was recorded on save, the data is verified and
+// ErrDigestMismatch is returned if it does not match.
+func (ce *Entry) DownloadTo(ctx context.Context, w io.WriterAt, opt DownloadOpt) error {
+	p := ce.progress.start(ce.Key)
+	err := ce.downloadTo(ctx, p, w, opt.withDefaults(ce.dl))
+	p.finish(err)
+	return err
+}
+
+func (ce *Entry) downloadTo(ctx context.Context, p *progress, w io.WriterAt, opt DownloadOpt) error {
+	d, err := ce.decoded(ctx, false)
+	if err != nil {
+		return err
+	}
+	size, err := d.payload.Size(ctx)
+	if err != nil {
+		return err
+	}
+	p.phase(PhaseDownload, ce.Key, size)
+	p.chunks(int((size + opt.ChunkSize - 1) / opt.ChunkSize))
+	ctx = withProgress(ctx, p)
+
+	if d.env == nil || d.env.Codec == CodecNone && d.env.KeyID == "" && d.env.Digest == "" {
+		return ce.downloadRanges(ctx, d.payload, w, size, opt)
+	}
+
+	// compressed and encrypted data is decoded in order, otherwise the ranges
+	// are written where they are fetched and only the digest is computed in
+	// order
+	var direct io.WriterAt
+	dst := io.Writer(io.NewOffsetWriter(w, 0))
+	if d.env.Codec == CodecNone && d.env.KeyID == "" {
+		direct, dst = w, io.Discard
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r, err := d.reader(newParallelReader(ctx, ce, d.payload, size, direct, opt))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(dst, r); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// downloadRanges writes the ranges of src to w as soon as they are fetched
+func (ce *Entry) downloadRanges(ctx context.Context, src EntrySource, w io.WriterAt, size int64, opt DownloadOpt) error {
+	var mu sync.Mutex
+	offset := int64(0)
+	eg, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < opt.Concurrency; i++ {
+		eg.Go(func() error {
+			for {
+				mu.Lock()
+				start := offset
+				if start >= size {
+					mu.Unlock()
+					return nil
+				}
+				end := min(start+opt.ChunkSize, size)
+				offset = end
+				mu.Unlock()
+
+				if err := copyRange(ctx, ce, src, io.NewOffsetWriter(w, start), start, end-start, opt.Retries); err != nil {
+					return err
+				}
+			}
+		})
+	}
+	return eg.Wait()
+}
+
+// parallelReader reads the data of src in order while fetching up to
+// Concurrency chunks ahead in parallel
+type parallelReader struct {
+	ctx    context.Context
+	chunks chan *pendingChunk
+	cur    []byte
+}
+
+type pendingChunk struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// newParallelReader returns a reader for the data of src. If w is not nil,
+// chunks are also written to w when they are fetched.
+func newParallelReader(ctx context.Context, ce *Entry, src EntrySource, size int64, w io.WriterAt, opt DownloadOpt) *parallelReader {
+	r := &parallelReader{
+		ctx:    ctx,
+		chunks: make(chan *pendingChunk, opt.Concurrency-1),
+	}
+	go func() {
+		defer close(r.chunks)
+		for offset := int64(0); offset < size; offset += opt.ChunkSize {
+			c := &pendingChunk{done: make(chan struct{})}
+			select {
+			case r.chunks <- c:
+			case <-ctx.Done():
+				return
+			}
+			go func(offset int64) {
+				defer close(c.done)
+				c.data, c.err = fetchRange(ctx, ce, src, offset, min(opt.ChunkSize, size-offset), opt.Retries)
+				if c.err == nil && w != nil {
+					_, c.err = w.WriteAt(c.data, offset)
+					c.err = errors.WithStack(c.err)
+				}
+			}(offset)
+		}
+	}()
+	return r
+}
+
+func (r *parallelReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		c, ok := <-r.chunks
+		if !ok {
+			if err := r.ctx.Err(); err != nil {
+				return 0, errors.WithStack(err)
+			}
+			return 0, io.EOF
+		}
+		select {
+		case <-c.done:
+		case <-r.ctx.Done():
+			return 0, errors.WithStack(r.ctx.Err())
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		r.cur = c.data
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// fetchRange reads length bytes at offset of src, a source of entry ce. If
+// reading fails, the request is retried for the remaining bytes.
+func fetchRange(ctx context.Context, ce *Entry, src EntrySource, offset, length int64, retries int) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, length))
+	if err := copyRange(ctx, ce, src, buf, offset, length, retries); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// copyRange copies length bytes at offset of src, a source of entry ce, to w.
+// If reading fails, the request is retried for the remaining bytes.
+func copyRange(ctx context.Context, ce *Entry, src EntrySource, w io.Writer, offset, length int64, retries int) error {
+	p := progressFrom(ctx)
+	var n int64
+	for attempt := 0; ; attempt++ {
+		if err := ce.sched.acquire(ctx); err != nil {
+			return err
+		}
+		nn, err := readRangeTo(ctx, src, w, offset+n, length-n)
+		ce.sched.release()
+		n += nn
+		p.add(nn)
+		if err == nil {
+			p.chunk()
+			return nil
+		}
+		if attempt >= retries || ctx.Err() != nil {
+			return errors.Wrapf(err, "failed to download range at offset %d after %d attempts", offset+n, attempt+1)
+		}
+		p.retry()
+		ce.log().Warn("retrying range", rangeAttr(offset+n, length-n), "attempt", attempt+1, errAttr(err))
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(time.Duration(attempt+1) * 100 * time.Millisecond):
+		}
+	}
+}
+
+func readRangeTo(ctx context.Context, src EntrySource, w io.Writer, offset, length int64) (int64, error) {
+	rc, err := src.Open(ctx, offset, length)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	n, err := io.Copy(w, io.LimitReader(rc, length))
+	if err == nil && n != length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, errors.Wrapf(err, "read %d bytes of range at offset %d, expected %d", n, offset, length)
+	}
+	return n, nil
+}
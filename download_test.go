@@ -0,0 +1,153 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// flakySource fails every range once after failAfter bytes
+type flakySource struct {
+	bytesSource
+	failAfter int64
+
+	mu     sync.Mutex
+	failed map[int64]bool
+	opens  []int64
+}
+
+func (f *flakySource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.opens = append(f.opens, offset)
+	rc, err := f.bytesSource.Open(ctx, offset, length)
+	if err != nil || f.failed[offset] {
+		return rc, err
+	}
+	f.failed[offset] = true
+	f.failed[offset+f.failAfter] = true // don't fail the resumed request
+	return io.NopCloser(io.MultiReader(io.LimitReader(rc, f.failAfter), errReader{})), nil
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+type writerAt []byte
+
+func (w writerAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(w[off:], p), nil
+}
+
+func TestDownloadToRetry(t *testing.T) {
+	ctx := context.TODO()
+	data := bytes.Repeat([]byte("abcdefghij"), 10000)
+	src := &flakySource{bytesSource: data, failAfter: 4, failed: map[int64]bool{}}
+	ce := NewEntry("foo", "", src)
+
+	buf := make(writerAt, len(data))
+	err := ce.DownloadTo(ctx, buf, DownloadOpt{Concurrency: 2, ChunkSize: 25000})
+	require.NoError(t, err)
+	require.Equal(t, data, []byte(buf))
+
+	// the start of the data is read once to detect the envelope and reused
+	// for the ranges it covers, every other range is resumed after the bytes
+	// that were already received
+	require.ElementsMatch(t, []int64{0, 0, int64(headSize), int64(headSize) + 4, 75000, 75004}, src.opens)
+
+	src = &flakySource{bytesSource: data, failAfter: 4, failed: map[int64]bool{}}
+	ce = NewEntry("foo", "", src)
+	err = ce.DownloadTo(ctx, make(writerAt, len(data)), DownloadOpt{ChunkSize: 25000, Retries: -1})
+	require.ErrorContains(t, err, "connection reset")
+}
+
+// countSource counts the requests made to a source
+type countSource struct {
+	bytesSource
+	opens, sizes int
+}
+
+func (s *countSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	s.opens++
+	return s.bytesSource.Open(ctx, offset, length)
+}
+
+func (s *countSource) Size(ctx context.Context) (int64, error) {
+	s.sizes++
+	return s.bytesSource.Size(ctx)
+}
+
+func TestWriteToSingleRequest(t *testing.T) {
+	ctx := context.TODO()
+	for _, n := range []int{0, 10, 2 * headSize} {
+		data := bytes.Repeat([]byte("a"), n)
+		src := &countSource{bytesSource: data}
+		ce := NewEntry("foo", "", src)
+
+		var buf bytes.Buffer
+		require.NoError(t, ce.WriteTo(ctx, &buf))
+		require.Equal(t, data, buf.Bytes())
+		// detecting the envelope reuses the request for the data
+		require.Equal(t, 1, src.opens)
+		require.Equal(t, 0, src.sizes)
+	}
+}
+
+// gateSource blocks opening the range at offset until open is closed
+type gateSource struct {
+	bytesSource
+	offset int64
+	open   chan struct{}
+}
+
+func (s *gateSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if offset == s.offset {
+		select {
+		case <-s.open:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return s.bytesSource.Open(ctx, offset, length)
+}
+
+// notifyWriterAt closes written when data is written at offset
+type notifyWriterAt struct {
+	writerAt
+	offset  int64
+	written chan struct{}
+}
+
+func (w *notifyWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.writerAt.WriteAt(p, off)
+	if off == w.offset {
+		close(w.written)
+	}
+	return n, err
+}
+
+func TestDownloadToUnordered(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+	chunk := int64(headSize)
+	data := bytes.Repeat([]byte("abcdefghij"), 4*headSize/10)
+	src := &gateSource{bytesSource: data, offset: chunk, open: make(chan struct{})}
+	w := &notifyWriterAt{writerAt: make(writerAt, len(data)), offset: 2 * chunk, written: make(chan struct{})}
+	go func() {
+		// a later range is written before an earlier one finished
+		<-w.written
+		close(src.open)
+	}()
+
+	err := NewEntry("foo", "", src).DownloadTo(ctx, w, DownloadOpt{Concurrency: 2, ChunkSize: chunk})
+	require.NoError(t, err)
+	require.Equal(t, data, []byte(w.writerAt))
+}
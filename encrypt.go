@@ -0,0 +1,294 @@
+package actionscache
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// EncryptionKey is an AES key for encrypting saved data. The ID is stored
+// with the entry so that the key can be rotated while older entries remain
+// readable.
+type EncryptionKey struct {
+	ID string
+	// Key is a 16, 24 or 32 byte AES key
+	Key []byte
+}
+
+// Data is encrypted in segments so that any range of it can be decrypted
+// without reading the data before it. Every segment is sealed with AES-GCM
+// using the base nonce combined with the segment index.
+const (
+	encryptSegmentSize = 64 * 1024
+	encryptCacheSize   = 8
+	// maxEncryptSegmentSize bounds the segment size read from the untrusted
+	// envelope header, as a segment is buffered in memory
+	maxEncryptSegmentSize = 4 * 1024 * 1024
+)
+
+func (k EncryptionKey) aead() (cipher.AEAD, error) {
+	if k.ID == "" {
+		return nil, errors.Errorf("encryption key ID is required")
+	}
+	block, err := aes.NewCipher(k.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid encryption key %s", k.ID)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aead, nil
+}
+
+func findKey(keys []EncryptionKey, id string) (EncryptionKey, bool) {
+	for _, k := range keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return EncryptionKey{}, false
+}
+
+// segmentCipher seals and opens the segments of a single entry
+type segmentCipher struct {
+	aead    cipher.AEAD
+	nonce   []byte
+	segSize int64
+	// hdr is the hash of the envelope header, authenticated with every
+	// segment
+	hdr []byte
+}
+
+func newSegmentCipher(key EncryptionKey, env *envelope, hdr []byte) (*segmentCipher, error) {
+	aead, err := key.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return nil, errors.Errorf("invalid nonce size %d", len(env.Nonce))
+	}
+	if env.SegmentSize <= 0 || env.SegmentSize > maxEncryptSegmentSize {
+		return nil, errors.Errorf("invalid segment size %d", env.SegmentSize)
+	}
+	h := sha256.Sum256(hdr)
+	return &segmentCipher{
+		aead:    aead,
+		nonce:   env.Nonce,
+		segSize: env.SegmentSize,
+		hdr:     h[:],
+	}, nil
+}
+
+func (sc *segmentCipher) segmentNonce(idx int64) []byte {
+	nonce := append([]byte{}, sc.nonce...)
+	n := len(nonce)
+	binary.BigEndian.PutUint64(nonce[n-8:], binary.BigEndian.Uint64(nonce[n-8:])^uint64(idx))
+	return nonce
+}
+
+// additionalData marks the last segment so that truncated data is detected
+func (sc *segmentCipher) additionalData(last bool) []byte {
+	ad := append([]byte{}, sc.hdr...)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+func (sc *segmentCipher) encSegSize() int64 {
+	return sc.segSize + int64(sc.aead.Overhead())
+}
+
+// segments returns the number of segments for plaintext of size. Empty data
+// is stored as one empty segment.
+func (sc *segmentCipher) segments(size int64) int64 {
+	return max(1, (size+sc.segSize-1)/sc.segSize)
+}
+
+func (sc *segmentCipher) encryptedSize(size int64) int64 {
+	return size + sc.segments(size)*int64(sc.aead.Overhead())
+}
+
+func (sc *segmentCipher) plaintextSize(size int64) (int64, error) {
+	n := (size + sc.encSegSize() - 1) / sc.encSegSize()
+	overhead := int64(sc.aead.Overhead())
+	if n == 0 || size-(n-1)*sc.encSegSize() < overhead {
+		return 0, errors.Errorf("invalid encrypted data size %d", size)
+	}
+	return size - n*overhead, nil
+}
+
+func newNonce(size int) ([]byte, error) {
+	nonce := make([]byte, size)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return nonce, nil
+}
+
+// encryptBlob encrypts the data of a blob on demand
+type encryptBlob struct {
+	Blob
+	sc *segmentCipher
+
+	mu    sync.Mutex
+	cache map[int64][]byte
+	order []int64
+}
+
+func (b *encryptBlob) Size() int64 {
+	return b.sc.encryptedSize(b.Blob.Size())
+}
+
+func (b *encryptBlob) ReadAt(p []byte, off int64) (int, error) {
+	size := b.Size()
+	var n int
+	for n < len(p) && off < size {
+		idx := off / b.sc.encSegSize()
+		seg, err := b.segment(idx)
+		if err != nil {
+			return n, err
+		}
+		nn := copy(p[n:], seg[off-idx*b.sc.encSegSize():])
+		n += nn
+		off += int64(nn)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// segment returns the sealed segment idx. Recent segments are cached because
+// readers usually read a segment in multiple calls.
+func (b *encryptBlob) segment(idx int64) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seg, ok := b.cache[idx]; ok {
+		return seg, nil
+	}
+	start := idx * b.sc.segSize
+	l := min(b.sc.segSize, b.Blob.Size()-start)
+	pt := make([]byte, l)
+	if n, err := b.Blob.ReadAt(pt, start); n < len(pt) {
+		return nil, errors.WithStack(err)
+	}
+	last := idx == b.sc.segments(b.Blob.Size())-1
+	seg := b.sc.aead.Seal(pt[:0], b.sc.segmentNonce(idx), pt, b.sc.additionalData(last))
+
+	if b.cache == nil {
+		b.cache = map[int64][]byte{}
+	}
+	b.cache[idx] = seg
+	b.order = append(b.order, idx)
+	if len(b.order) > encryptCacheSize {
+		delete(b.cache, b.order[0])
+		b.order = b.order[1:]
+	}
+	return seg, nil
+}
+
+// decryptSource provides random access to encrypted data
+type decryptSource struct {
+	src EntrySource
+	sc  *segmentCipher
+
+	mu      sync.Mutex
+	encSize int64
+}
+
+func (s *decryptSource) encryptedSize(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.encSize == 0 {
+		size, err := s.src.Size(ctx)
+		if err != nil {
+			return 0, err
+		}
+		s.encSize = size
+	}
+	return s.encSize, nil
+}
+
+func (s *decryptSource) Size(ctx context.Context) (int64, error) {
+	size, err := s.encryptedSize(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return s.sc.plaintextSize(size)
+}
+
+func (s *decryptSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	encSize, err := s.encryptedSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	idx := offset / s.sc.segSize
+	encLength := int64(-1)
+	if length >= 0 {
+		end := (offset + length + s.sc.segSize - 1) / s.sc.segSize
+		encLength = min(end*s.sc.encSegSize(), encSize) - idx*s.sc.encSegSize()
+	}
+	rc, err := s.src.Open(ctx, idx*s.sc.encSegSize(), encLength)
+	if err != nil {
+		return nil, err
+	}
+	r := &decryptReader{
+		r:    rc,
+		sc:   s.sc,
+		idx:  idx,
+		last: (encSize+s.sc.encSegSize()-1)/s.sc.encSegSize() - 1,
+		skip: offset - idx*s.sc.segSize,
+		buf:  make([]byte, s.sc.encSegSize()),
+	}
+	var rd io.Reader = r
+	if length >= 0 {
+		rd = io.LimitReader(r, length)
+	}
+	return &readCloser{Reader: rd, Closer: rc}, nil
+}
+
+// decryptReader decrypts a stream of sealed segments starting at segment idx
+type decryptReader struct {
+	r    io.Reader
+	sc   *segmentCipher
+	idx  int64
+	last int64
+	skip int64
+	buf  []byte
+	cur  []byte
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.cur) == 0 {
+		if d.idx > d.last {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.buf)
+		if err != nil && !(errors.Is(err, io.ErrUnexpectedEOF) && d.idx == d.last) {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, errors.Wrapf(err, "failed to read encrypted segment %d", d.idx)
+		}
+		pt, err := d.sc.aead.Open(d.buf[:0], d.sc.segmentNonce(d.idx), d.buf[:n], d.sc.additionalData(d.idx == d.last))
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to decrypt segment %d", d.idx)
+		}
+		d.idx++
+		skip := min(d.skip, int64(len(pt)))
+		d.cur = pt[skip:]
+		d.skip -= skip
+	}
+	n := copy(p, d.cur)
+	d.cur = d.cur[n:]
+	return n, nil
+}
@@ -0,0 +1,120 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		key1 := EncryptionKey{ID: "key1", Key: bytes.Repeat([]byte{1}, 32)}
+		key2 := EncryptionKey{ID: "key2", Key: bytes.Repeat([]byte{2}, 16)}
+		c, s := newTestCache(t, v2, Opt{EncryptionKeys: []EncryptionKey{key1}})
+
+		data := make([]byte, 200*1024+17)
+		for i := range data {
+			data[i] = byte(i / 7)
+		}
+		err := c.Save(ctx, "encrypted", NewBlob(data))
+		require.NoError(t, err)
+
+		s.mu.Lock()
+		stored := append([]byte{}, s.entries[0].data...)
+		s.mu.Unlock()
+		require.False(t, bytes.Contains(stored, data[1000:1100]))
+
+		c2, err := s.newCache(v2, Opt{})
+		require.NoError(t, err)
+		ce, err := c2.Load(ctx, "encrypted")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+		require.ErrorContains(t, ce.WriteTo(ctx, io.Discard), `no key "key1"`)
+
+		// after rotation entries saved with the old key remain readable
+		c, err = s.newCache(v2, Opt{
+			EncryptionKeys: []EncryptionKey{key2, key1},
+			Compression:    CodecZstd,
+		})
+		require.NoError(t, err)
+		ce, err = c.Load(ctx, "encrypted")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+
+		size, err := ce.Size(ctx)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), size)
+
+		buf := &bytes.Buffer{}
+		require.NoError(t, ce.WriteTo(ctx, buf))
+		require.Equal(t, data, buf.Bytes())
+
+		wa := make(writerAt, len(data))
+		require.NoError(t, ce.DownloadTo(ctx, wa, DownloadOpt{ChunkSize: 50000}))
+		require.Equal(t, data, []byte(wa))
+
+		rac := ce.Download(ctx)
+		for _, off := range []int64{0, 65530, 131072, int64(len(data)) - 10} {
+			dt := make([]byte, 10)
+			_, err = rac.ReadAt(dt, off)
+			require.NoError(t, err)
+			require.Equal(t, data[off:off+10], dt)
+		}
+		require.NoError(t, rac.Close())
+
+		for _, v := range []string{"a", "b"} {
+			err = c.SaveMutable(ctx, "mutable", time.Second, func(ce *Entry) (Blob, error) {
+				buf := &bytes.Buffer{}
+				if ce != nil {
+					if err := ce.WriteTo(ctx, buf); err != nil {
+						return nil, err
+					}
+				}
+				buf.WriteString(v)
+				return NewBlob(buf.Bytes()), nil
+			})
+			require.NoError(t, err)
+		}
+		ce, err = c.Load(ctx, "mutable")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+		buf.Reset()
+		require.NoError(t, ce.WriteTo(ctx, buf))
+		require.Equal(t, "ab", buf.String())
+
+		// modified data fails to decrypt
+		s.mu.Lock()
+		e := s.entries[0]
+		e.data[len(e.data)-100] ^= 0xff
+		s.mu.Unlock()
+		ce, err = c.Load(ctx, "encrypted")
+		require.NoError(t, err)
+		require.ErrorContains(t, ce.WriteTo(ctx, io.Discard), "failed to decrypt")
+
+		c, err = s.newCache(v2, Opt{
+			EncryptionKeys: []EncryptionKey{{ID: "short", Key: []byte("foo")}},
+		})
+		require.NoError(t, err)
+		err = c.Save(ctx, "invalid", NewBlob(data))
+		require.ErrorContains(t, err, "invalid encryption key short")
+	})
+}
+
+func TestSegmentCipherHeader(t *testing.T) {
+	key := EncryptionKey{ID: "k1", Key: make([]byte, 32)}
+	env := &envelope{KeyID: "k1", Nonce: make([]byte, 12), SegmentSize: encryptSegmentSize}
+	_, err := newSegmentCipher(key, env, nil)
+	require.NoError(t, err)
+
+	// the header is not trusted so segment sizes that can't be buffered are rejected
+	for _, size := range []int64{0, -1, maxEncryptSegmentSize + 1, 1 << 60} {
+		env.SegmentSize = size
+		_, err := newSegmentCipher(key, env, nil)
+		require.ErrorContains(t, err, "invalid segment size")
+	}
+}
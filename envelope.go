@@ -0,0 +1,485 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Saved data can be wrapped in an envelope that starts with a small header
+// describing how the payload following it was written. Readers detect the
+// envelope by its magic so entries with and without one can be mixed.
+//
+//	magic (8 bytes) | header length (uint32, big endian) | JSON header | payload
+const (
+	envelopeMagic     = "\x00GHACE\x00\x01"
+	envelopePrefixLen = len(envelopeMagic) + 4
+	maxEnvelopeHeader = 64 * 1024
+	// headSize is how much of the data is read to detect the envelope
+	headSize = envelopePrefixLen + maxEnvelopeHeader
+)
+
+type envelope struct {
+	// Digest and Size describe the data passed to Save
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	// Codec is the compression of the payload
+	Codec Codec `json:"codec,omitempty"`
+	// KeyID, Nonce and SegmentSize are set if the payload is encrypted
+	KeyID       string `json:"keyID,omitempty"`
+	Nonce       []byte `json:"nonce,omitempty"`
+	SegmentSize int64  `json:"segmentSize,omitempty"`
+
+	// offset is where the payload starts in the saved blob
+	offset int64
+	// raw is the encoded header
+	raw []byte
+}
+
+// ErrDigestMismatch is returned when the data read for an entry does not match
+// the digest recorded when it was saved.
+type ErrDigestMismatch struct {
+	Expected string
+	Actual   string
+}
+
+func (e ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("digest mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// encode wraps b in an envelope if any of the options requiring one are set.
+// Encrypted data reuses the nonce of an interrupted upload of key so that the
+// upload can be resumed. Closing the returned blob does not close b.
+func (c *Cache) encode(key string, b Blob) (Blob, error) {
+	if err := c.opt.Compression.validate(); err != nil {
+		return nil, err
+	}
+	if c.plain || !c.opt.RecordDigest && c.opt.Compression == CodecNone && len(c.opt.EncryptionKeys) == 0 {
+		return &nopCloseBlob{b}, nil
+	}
+	env := envelope{
+		Size:  b.Size(),
+		Codec: c.opt.Compression,
+	}
+	payload := Blob(&nopCloseBlob{b})
+	if env.Codec != CodecNone {
+		cb, dgst, err := compress(b, env.Codec)
+		if err != nil {
+			return nil, err
+		}
+		payload, env.Digest = cb, dgst
+	} else {
+		dgst, err := blobDigest(b)
+		if err != nil {
+			return nil, err
+		}
+		env.Digest = dgst
+	}
+	var ek EncryptionKey
+	if len(c.opt.EncryptionKeys) > 0 {
+		ek = c.opt.EncryptionKeys[0]
+		// a digest of the plaintext would reveal information about it,
+		// integrity is already guaranteed by the encryption
+		env.Digest = ""
+		env.KeyID = ek.ID
+		env.SegmentSize = encryptSegmentSize
+		nonce, err := c.resumeNonce(key)
+		if err == nil && nonce == nil {
+			nonce, err = newNonce(12)
+		}
+		if err != nil {
+			payload.Close()
+			return nil, err
+		}
+		env.Nonce = nonce
+	}
+	hdr, err := json.Marshal(env)
+	if err != nil {
+		payload.Close()
+		return nil, errors.WithStack(err)
+	}
+	if env.KeyID != "" {
+		sc, err := newSegmentCipher(ek, &env, hdr)
+		if err != nil {
+			payload.Close()
+			return nil, err
+		}
+		payload = &encryptBlob{Blob: payload, sc: sc}
+	}
+	prefix := make([]byte, envelopePrefixLen, envelopePrefixLen+len(hdr))
+	copy(prefix, envelopeMagic)
+	binary.BigEndian.PutUint32(prefix[len(envelopeMagic):], uint32(len(hdr)))
+	return &concatBlob{head: append(prefix, hdr...), tail: payload, nonce: env.Nonce}, nil
+}
+
+// parseEnvelope returns the envelope header at the start of head or nil if the
+// data was saved without one. head needs to hold the complete header.
+func parseEnvelope(head []byte) (*envelope, error) {
+	if len(head) < envelopePrefixLen || string(head[:len(envelopeMagic)]) != envelopeMagic {
+		return nil, nil
+	}
+	n := int(binary.BigEndian.Uint32(head[len(envelopeMagic):]))
+	if n > maxEnvelopeHeader || envelopePrefixLen+n > len(head) {
+		return nil, errors.Errorf("invalid envelope header length %d", n)
+	}
+	dt := head[envelopePrefixLen : envelopePrefixLen+n]
+	var env envelope
+	if err := json.Unmarshal(dt, &env); err != nil {
+		return nil, errors.Wrap(err, "failed to parse envelope header")
+	}
+	if err := env.Codec.validate(); err != nil {
+		return nil, err
+	}
+	env.offset = int64(envelopePrefixLen + n)
+	env.raw = dt
+	return &env, nil
+}
+
+// decodedEntry describes how to read the data of an entry
+type decodedEntry struct {
+	// payload is the data following the envelope, decrypted if needed
+	payload EntrySource
+	// src is the original data passed to Save
+	src EntrySource
+	// env is nil if the entry was saved without an envelope
+	env *envelope
+	// head holds the start of the saved data
+	head *headSource
+}
+
+// reader returns the original data from a reader of the payload
+func (d *decodedEntry) reader(r io.Reader) (io.ReadCloser, error) {
+	if d.env == nil {
+		return io.NopCloser(r), nil
+	}
+	rc, err := d.env.Codec.newReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var vr io.Reader = rc
+	if d.env.Digest != "" {
+		vr = newVerifyReader(rc, d.env.Digest, d.env.Size)
+	}
+	return &readCloser{Reader: vr, Closer: rc}, nil
+}
+
+// decoded detects how the entry was saved. If keep is set, the request used
+// for reading the start of the data is kept open for reading the rest of it
+// until decodedEntry.head is released.
+func (ce *Entry) decoded(ctx context.Context, keep bool) (*decodedEntry, error) {
+	ce.decodeMu.Lock()
+	defer ce.decodeMu.Unlock()
+	if ce.dec != nil {
+		return ce.dec, nil
+	}
+	head, err := readHead(ctx, ce, ce.source(), keep)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDecodedEntry(ce, head)
+	if err != nil {
+		head.release()
+		return nil, err
+	}
+	ce.dec = d
+	return d, nil
+}
+
+func newDecodedEntry(ce *Entry, head *headSource) (*decodedEntry, error) {
+	env, err := parseEnvelope(head.head)
+	if err != nil {
+		return nil, err
+	}
+	d := &decodedEntry{payload: head, src: head, env: env, head: head}
+	if env != nil {
+		d.payload = &offsetSource{src: head, offset: env.offset}
+		if env.KeyID != "" {
+			key, ok := findKey(ce.keys, env.KeyID)
+			if !ok {
+				return nil, errors.Errorf("no key %q to decrypt cache entry %s", env.KeyID, ce.Key)
+			}
+			sc, err := newSegmentCipher(key, env, env.raw)
+			if err != nil {
+				return nil, err
+			}
+			d.payload = &decryptSource{src: d.payload, sc: sc}
+		}
+		d.src = d.payload
+		if env.Codec != CodecNone {
+			d.src = &decompressSource{src: d.payload, codec: env.Codec, size: env.Size}
+		}
+	}
+	return d, nil
+}
+
+// reader returns a reader for the original data of the entry
+func (ce *Entry) reader(ctx context.Context) (io.ReadCloser, error) {
+	d, err := ce.decoded(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer d.head.release()
+	p := progressFrom(ctx)
+	if p != nil {
+		size, err := d.payload.Size(ctx)
+		if err != nil {
+			size = -1
+		}
+		p.phase(PhaseDownload, ce.Key, size)
+	}
+	rc, err := d.payload.Open(ctx, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		rc = &readCloser{Reader: &countReader{Reader: rc, p: p}, Closer: rc}
+	}
+	r, err := d.reader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: r, Closer: multiCloser{r, rc}}, nil
+}
+
+// Digest returns the digest of the entry data recorded on save. An empty
+// string is returned if no digest was recorded.
+func (ce *Entry) Digest(ctx context.Context) (string, error) {
+	d, err := ce.decoded(ctx, false)
+	if err != nil || d.env == nil {
+		return "", err
+	}
+	return d.env.Digest, nil
+}
+
+// entrySource is the lazily decoded source of an entry
+type entrySource Entry
+
+func (s *entrySource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	d, err := (*Entry)(s).decoded(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return d.src.Open(ctx, offset, length)
+}
+
+func (s *entrySource) Size(ctx context.Context) (int64, error) {
+	d, err := (*Entry)(s).decoded(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	return d.src.Size(ctx)
+}
+
+// offsetSource skips the envelope header
+type offsetSource struct {
+	src    EntrySource
+	offset int64
+}
+
+func (s *offsetSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	return s.src.Open(ctx, s.offset+offset, length)
+}
+
+func (s *offsetSource) Size(ctx context.Context) (int64, error) {
+	size, err := s.src.Size(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return size - s.offset, nil
+}
+
+// headSource serves the start of the data of src that was read when
+// detecting the envelope, so that reading the header does not cost additional
+// requests
+type headSource struct {
+	src  EntrySource
+	head []byte
+	// eof is set if head holds all of the data
+	eof bool
+
+	mu sync.Mutex
+	// rest continues the request that head was read from
+	rest io.ReadCloser
+}
+
+// readHead reads the start of the data of src. The request is retried if it
+// fails.
+func readHead(ctx context.Context, ce *Entry, src EntrySource, keep bool) (*headSource, error) {
+	for attempt := 0; ; attempt++ {
+		h, err := openHead(ctx, ce, src, keep)
+		if err == nil {
+			return h, nil
+		}
+		if attempt >= defaultDownloadRetries || ctx.Err() != nil {
+			return nil, errors.Wrapf(err, "failed to read cache entry %s after %d attempts", ce.Key, attempt+1)
+		}
+		ce.log().Warn("retrying read of entry header", "attempt", attempt+1, errAttr(err))
+		select {
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		case <-time.After(time.Duration(attempt+1) * 100 * time.Millisecond):
+		}
+	}
+}
+
+func openHead(ctx context.Context, ce *Entry, src EntrySource, keep bool) (*headSource, error) {
+	if err := ce.sched.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer ce.sched.release()
+	// the range is not bounded as that would fail for empty blobs
+	rc, err := src.Open(ctx, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, headSize)
+	n, err := io.ReadFull(rc, buf)
+	h := &headSource{src: src, head: buf[:n]}
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		h.eof = true
+	default:
+		rc.Close()
+		return nil, errors.WithStack(err)
+	}
+	if keep && !h.eof {
+		h.rest = rc
+	} else {
+		rc.Close()
+	}
+	return h, nil
+}
+
+func (s *headSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	size := int64(len(s.head))
+	if offset >= size {
+		if s.eof {
+			return io.NopCloser(&bytes.Reader{}), nil
+		}
+		return s.openRest(ctx, offset, length)
+	}
+	h := s.head[offset:]
+	if length >= 0 && length <= int64(len(h)) {
+		return io.NopCloser(bytes.NewReader(h[:length])), nil
+	}
+	if s.eof {
+		return io.NopCloser(bytes.NewReader(h)), nil
+	}
+	if length >= 0 {
+		length -= int64(len(h))
+	}
+	rc, err := s.openRest(ctx, size, length)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{Reader: io.MultiReader(bytes.NewReader(h), rc), Closer: rc}, nil
+}
+
+// openRest opens the data at offset after head. The request head was read from
+// is reused if it continues at offset.
+func (s *headSource) openRest(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	rest := s.rest
+	s.rest = nil
+	s.mu.Unlock()
+	if rest != nil {
+		if offset == int64(len(s.head)) && length < 0 {
+			return rest, nil
+		}
+		rest.Close()
+	}
+	return s.src.Open(ctx, offset, length)
+}
+
+func (s *headSource) Size(ctx context.Context) (int64, error) {
+	if s.eof {
+		return int64(len(s.head)), nil
+	}
+	return s.src.Size(ctx)
+}
+
+// release closes the request head was read from if it was not used
+func (s *headSource) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rest != nil {
+		s.rest.Close()
+		s.rest = nil
+	}
+}
+
+// verifyReader checks the digest and size of the data read when the end of
+// the data is reached. Size is not checked if it is negative.
+type verifyReader struct {
+	r      io.Reader
+	h      hash.Hash
+	n      int64
+	digest string
+	size   int64
+}
+
+func newVerifyReader(r io.Reader, digest string, size int64) io.Reader {
+	return &verifyReader{r: r, h: sha256.New(), digest: digest, size: size}
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+	if err == io.EOF {
+		dgst := "sha256:" + hex.EncodeToString(v.h.Sum(nil))
+		if dgst != v.digest || (v.size >= 0 && v.n != v.size) {
+			return n, errors.WithStack(ErrDigestMismatch{Expected: v.digest, Actual: dgst})
+		}
+	}
+	return n, err
+}
+
+// concatBlob is a blob of head followed by the data of tail
+type concatBlob struct {
+	head []byte
+	tail Blob
+	// nonce of the encrypted tail, recorded in upload journals
+	nonce []byte
+}
+
+func (b *concatBlob) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	if off < int64(len(b.head)) {
+		n = copy(p, b.head[off:])
+		if n == len(p) {
+			return n, nil
+		}
+		off = int64(len(b.head))
+	}
+	nn, err := b.tail.ReadAt(p[n:], off-int64(len(b.head)))
+	return n + nn, err
+}
+
+func (b *concatBlob) Size() int64 {
+	return int64(len(b.head)) + b.tail.Size()
+}
+
+func (b *concatBlob) Close() error {
+	return b.tail.Close()
+}
+
+type nopCloseBlob struct {
+	Blob
+}
+
+func (b *nopCloseBlob) Close() error {
+	return nil
+}
@@ -0,0 +1,84 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigest(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, s := newTestCache(t, v2, Opt{RecordDigest: true})
+
+		data := bytes.Repeat([]byte("0123456789"), 10)
+		err := c.Save(ctx, "digest", NewBlob(data))
+		require.NoError(t, err)
+
+		// readers detect the digest without any options
+		c2, err := s.newCache(v2, Opt{})
+		require.NoError(t, err)
+		ce, err := c2.Load(ctx, "digest")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+
+		dgst, err := ce.Digest(ctx)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("sha256:%x", sha256.Sum256(data)), dgst)
+
+		size, err := ce.Size(ctx)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), size)
+
+		buf := &bytes.Buffer{}
+		require.NoError(t, ce.WriteTo(ctx, buf))
+		require.Equal(t, data, buf.Bytes())
+
+		wa := make(writerAt, len(data))
+		require.NoError(t, ce.DownloadTo(ctx, wa, DownloadOpt{ChunkSize: 7}))
+		require.Equal(t, data, []byte(wa))
+
+		rac := ce.Download(ctx)
+		dt := make([]byte, 5)
+		_, err = rac.ReadAt(dt, 12)
+		require.NoError(t, err)
+		require.Equal(t, "23456", string(dt))
+		require.NoError(t, rac.Close())
+
+		// corrupt the stored data
+		s.mu.Lock()
+		e := s.entries[0]
+		e.data[len(e.data)-1] ^= 0xff
+		s.mu.Unlock()
+
+		ce, err = c2.Load(ctx, "digest")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+
+		var dm ErrDigestMismatch
+		err = ce.WriteTo(ctx, io.Discard)
+		require.True(t, errors.As(err, &dm))
+		require.Equal(t, dgst, dm.Expected)
+
+		err = ce.DownloadTo(ctx, make(writerAt, len(data)), DownloadOpt{ChunkSize: 7})
+		require.True(t, errors.As(err, &dm))
+
+		// entries without a digest are read as before
+		err = c2.Save(ctx, "plain", NewBlob(data))
+		require.NoError(t, err)
+		ce, err = c2.Load(ctx, "plain")
+		require.NoError(t, err)
+		dgst, err = ce.Digest(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "", dgst)
+		buf.Reset()
+		require.NoError(t, ce.WriteTo(ctx, buf))
+		require.Equal(t, data, buf.Bytes())
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package actionscache
+
+import "os"
+
+// files are not locked on platforms without file locks
+func lockFile(*os.File, bool) error {
+	return nil
+}
+
+func unlockFile(*os.File) error {
+	return nil
+}
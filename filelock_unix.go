@@ -0,0 +1,27 @@
+//go:build unix
+
+package actionscache
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return errors.WithStack(syscall.Flock(int(f.Fd()), syscall.LOCK_UN))
+}
@@ -0,0 +1,242 @@
+package actionscache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// uploadJournal records the progress of a v1 upload so that a Save of the
+// same key after a crash can continue with the reserved cache ID instead of
+// failing because the key already exists.
+type uploadJournal struct {
+	path string
+	log  *slog.Logger
+	mu   sync.Mutex
+
+	CacheID string `json:"cacheID"`
+	Key     string `json:"key"`
+	Version string `json:"version"`
+	// Size and Digest identify the blob being uploaded. They are empty until
+	// the upload starts.
+	Size   int64  `json:"size"`
+	Digest string `json:"digest,omitempty"`
+	// Nonce of encrypted data, reused when resuming so that the data is
+	// encrypted the same way
+	Nonce []byte `json:"nonce,omitempty"`
+	// Chunks are the byte ranges acknowledged by the server
+	Chunks []journalChunk `json:"chunks,omitempty"`
+}
+
+type journalChunk struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // exclusive
+}
+
+func (c *Cache) journalPath(key string) string {
+	dgst := sha256.Sum256([]byte(c.URL + "\x00" + key + "\x00" + c.version()))
+	return filepath.Join(c.opt.UploadJournalDir, hex.EncodeToString(dgst[:])+".json")
+}
+
+// newJournal creates the journal after a cache ID has been reserved
+func (c *Cache) newJournal(key, id string) (*uploadJournal, error) {
+	if err := os.MkdirAll(c.opt.UploadJournalDir, 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	j := &uploadJournal{
+		path:    c.journalPath(key),
+		log:     c.log(),
+		CacheID: id,
+		Key:     key,
+		Version: c.version(),
+	}
+	if err := j.save(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// loadJournal returns the journal for key or nil if there is none
+func (c *Cache) loadJournal(key string) (*uploadJournal, error) {
+	p := c.journalPath(key)
+	dt, err := os.ReadFile(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	j := &uploadJournal{path: p, log: c.log()}
+	if err := json.Unmarshal(dt, j); err != nil {
+		// a corrupt journal can't be resumed
+		c.log().Warn("removing invalid upload journal", "key", key, "path", p, errAttr(err))
+		os.Remove(p)
+		return nil, nil
+	}
+	if j.Key != key || j.Version != c.version() {
+		return nil, nil
+	}
+	return j, nil
+}
+
+// save writes the journal atomically. Called with the lock held.
+func (j *uploadJournal) save() error {
+	dt, err := json.Marshal(j)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, dt, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, j.path))
+}
+
+func (j *uploadJournal) remove() {
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		j.log.Warn("failed to remove upload journal", "key", j.Key, "path", j.path, errAttr(err))
+	}
+}
+
+// start binds the journal to a blob. If the journal was recorded for a
+// different blob, the acknowledged chunks can't be reused and false is
+// returned.
+func (j *uploadJournal) start(b Blob) (bool, error) {
+	dgst, err := blobDigest(b)
+	if err != nil {
+		return false, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.Digest != "" {
+		return j.Digest == dgst && j.Size == b.Size(), nil
+	}
+	j.Size = b.Size()
+	j.Digest = dgst
+	if cb, ok := b.(*concatBlob); ok {
+		j.Nonce = cb.nonce
+	}
+	return true, j.save()
+}
+
+// ack records a chunk acknowledged by the server
+func (j *uploadJournal) ack(start, end int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Chunks = append(j.Chunks, journalChunk{Start: start, End: end})
+	return j.save()
+}
+
+// missing returns the ranges of size that have not been acknowledged
+func (j *uploadJournal) missing(size int64) []journalChunk {
+	j.mu.Lock()
+	chunks := append([]journalChunk{}, j.Chunks...)
+	j.mu.Unlock()
+
+	sort.Slice(chunks, func(i, k int) bool {
+		return chunks[i].Start < chunks[k].Start
+	})
+	var out []journalChunk
+	offset := int64(0)
+	for _, ch := range chunks {
+		if ch.Start > offset {
+			out = append(out, journalChunk{Start: offset, End: min(ch.Start, size)})
+		}
+		offset = max(offset, ch.End)
+	}
+	if offset < size {
+		out = append(out, journalChunk{Start: offset, End: size})
+	}
+	return out
+}
+
+// resumeNonce returns the nonce recorded by an interrupted upload of key, or
+// nil if there is none
+func (c *Cache) resumeNonce(key string) ([]byte, error) {
+	if key == "" || c.opt.UploadJournalDir == "" {
+		return nil, nil
+	}
+	j, err := c.loadJournal(key)
+	if err != nil || j == nil {
+		return nil, err
+	}
+	return j.Nonce, nil
+}
+
+// dropJournalOnError removes the journal if err shows that the reserved cache
+// ID can't be used anymore
+func (c *Cache) dropJournalOnError(key string, err error) {
+	var he HTTPError
+	if !errors.As(err, &he) || he.StatusCode < 400 || he.StatusCode >= 500 || he.StatusCode == http.StatusTooManyRequests {
+		return
+	}
+	if j, _ := c.loadJournal(key); j != nil {
+		j.remove()
+	}
+}
+
+func blobDigest(b Blob) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(b, 0, b.Size())); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// resumeV1 returns a reservation for key from an upload journal left by an
+// interrupted Save, or nil if there is no journal or the entry has already
+// been committed.
+func (c *Cache) resumeV1(ctx context.Context, key, version string) (*Reservation, error) {
+	j, err := c.loadJournal(key)
+	if err != nil || j == nil {
+		return nil, err
+	}
+	if _, err := strconv.Atoi(j.CacheID); err != nil {
+		j.remove()
+		return nil, nil
+	}
+	// the journal is left behind if Save stopped after the commit
+	ce, err := c.loadV1(ctx, version, key)
+	if err != nil {
+		return nil, err
+	}
+	if ce != nil && ce.Key == key {
+		j.remove()
+		return nil, nil
+	}
+	c.log().Info("resuming upload", "operation", "upload", "key", key, "cache_id", j.CacheID)
+	return &Reservation{Key: key, Version: j.Version, ID: j.CacheID}, nil
+}
+
+// uploadV1Journal uploads the chunks of b that are missing from the journal
+func (c *Cache) uploadV1Journal(ctx context.Context, r *Reservation, b Blob) error {
+	j, err := c.loadJournal(r.Key)
+	if err != nil {
+		return err
+	}
+	if j == nil || j.CacheID != r.ID {
+		if j, err = c.newJournal(r.Key, r.ID); err != nil {
+			return err
+		}
+	}
+	ok, err := j.start(b)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// the reserved ID belongs to a different blob that was never committed
+		return errors.Wrapf(os.ErrExist, "cache key %s is reserved by an interrupted upload of different data", r.Key)
+	}
+	return c.uploadV1Ranges(ctx, r.ID, b, j.missing(b.Size()), j.ack)
+}
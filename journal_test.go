@@ -0,0 +1,149 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// patchTransport counts chunk uploads and fails the ones after failAfter
+type patchTransport struct {
+	mu        sync.Mutex
+	patches   int
+	failAfter int
+}
+
+func (t *patchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPatch {
+		t.mu.Lock()
+		t.patches++
+		fail := t.failAfter > 0 && t.patches > t.failAfter
+		t.mu.Unlock()
+		if fail {
+			return nil, errors.New("connection lost")
+		}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestResumeUpload(t *testing.T) {
+	ctx := context.TODO()
+	s := newTestServer(t)
+	dir := t.TempDir()
+
+	data := []byte("0123456789")
+	tr := &patchTransport{failAfter: 2}
+	// the connection stays down so the upload is interrupted
+	noRetry := &ExponentialRetryPolicy{MaxAttempts: 1}
+	c, err := s.newCache(false, Opt{Client: &http.Client{Transport: tr}, RetryPolicy: noRetry, UploadJournalDir: dir, UploadChunkSize: 3, UploadConcurrency: 1})
+	require.NoError(t, err)
+	err = c.Save(ctx, "resume", NewBlob(data))
+	require.ErrorContains(t, err, "connection lost")
+	require.Empty(t, s.Keys())
+
+	// different data can't reuse the reservation
+	tr = &patchTransport{}
+	c, err = s.newCache(false, Opt{Client: &http.Client{Transport: tr}, UploadJournalDir: dir, UploadChunkSize: 3, UploadConcurrency: 1})
+	require.NoError(t, err)
+	err = c.Save(ctx, "resume", NewBlob([]byte("abcdefghij")))
+	require.ErrorIs(t, err, os.ErrExist)
+	require.Equal(t, 0, tr.patches)
+
+	// without a journal the key stays blocked
+	c2, err := s.newCache(false, Opt{})
+	require.NoError(t, err)
+	err = c2.Save(ctx, "resume", NewBlob(data))
+	require.ErrorIs(t, err, os.ErrExist)
+
+	err = c.Save(ctx, "resume", NewBlob(data))
+	require.NoError(t, err)
+	require.Equal(t, 2, tr.patches) // only the missing chunks
+	require.Equal(t, []string{"resume"}, s.Keys())
+
+	ce, err := c.Load(ctx, "resume")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	buf := &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	require.Equal(t, string(data), buf.String())
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestResumeEncryptedUpload(t *testing.T) {
+	ctx := context.TODO()
+	s := newTestServer(t)
+	dir := t.TempDir()
+	keys := []EncryptionKey{{ID: "k1", Key: bytes.Repeat([]byte("k"), 32)}}
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	noRetry := &ExponentialRetryPolicy{MaxAttempts: 1}
+
+	tr := &patchTransport{failAfter: 2}
+	c, err := s.newCache(false, Opt{Client: &http.Client{Transport: tr}, RetryPolicy: noRetry, EncryptionKeys: keys, UploadJournalDir: dir, UploadChunkSize: 16, UploadConcurrency: 1})
+	require.NoError(t, err)
+	err = c.Save(ctx, "enc", NewBlob(data))
+	require.ErrorContains(t, err, "connection lost")
+	require.Empty(t, s.Keys())
+
+	// the retry encrypts with the same nonce so the acknowledged chunks are reused
+	tr = &patchTransport{}
+	c, err = s.newCache(false, Opt{Client: &http.Client{Transport: tr}, EncryptionKeys: keys, UploadJournalDir: dir, UploadChunkSize: 16, UploadConcurrency: 1})
+	require.NoError(t, err)
+	require.NoError(t, c.Save(ctx, "enc", NewBlob(data)))
+	require.Greater(t, tr.patches, 0)
+	require.Equal(t, []string{"enc"}, s.Keys())
+
+	ce, err := c.Load(ctx, "enc")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	buf := &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	require.Equal(t, data, buf.Bytes())
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestResumeCommittedUpload(t *testing.T) {
+	ctx := context.TODO()
+	s := newTestServer(t)
+	dir := t.TempDir()
+	data := []byte("0123456789")
+	noRetry := &ExponentialRetryPolicy{MaxAttempts: 1}
+
+	tr := &patchTransport{failAfter: 2}
+	c, err := s.newCache(false, Opt{Client: &http.Client{Transport: tr}, RetryPolicy: noRetry, UploadJournalDir: dir, UploadChunkSize: 3, UploadConcurrency: 1})
+	require.NoError(t, err)
+	require.ErrorContains(t, c.Save(ctx, "committed", NewBlob(data)), "connection lost")
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	journal := filepath.Join(dir, files[0].Name())
+	dt, err := os.ReadFile(journal)
+	require.NoError(t, err)
+
+	tr = &patchTransport{}
+	c, err = s.newCache(false, Opt{Client: &http.Client{Transport: tr}, UploadJournalDir: dir, UploadChunkSize: 3, UploadConcurrency: 1})
+	require.NoError(t, err)
+	require.NoError(t, c.Save(ctx, "committed", NewBlob(data)))
+
+	// as if the process stopped after the commit but before removing the journal
+	require.NoError(t, os.WriteFile(journal, dt, 0600))
+	tr.patches = 0
+	err = c.Save(ctx, "committed", NewBlob(data))
+	require.ErrorIs(t, err, os.ErrExist)
+	require.Equal(t, 0, tr.patches)
+	files, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
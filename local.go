@@ -0,0 +1,200 @@
+package actionscache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	localDataFile  = "data"
+	localEntryFile = "entry.json"
+)
+
+// LocalBackend is a VersionedBackend that stores entries in a local
+// directory. Keys are matched with the same rules as the GitHub cache service
+// so code using Cache behaves the same way on a developer machine or a
+// self-hosted runner.
+//
+// Every key and version gets its own subdirectory. Creating the directory
+// reserves the key and the entry becomes visible when its metadata file is
+// written on commit. Multiple processes may share the same directory.
+type LocalBackend struct {
+	root string
+}
+
+type localEntry struct {
+	Key       string    `json:"key"`
+	Version   string    `json:"version"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// NewLocalBackend returns a backend storing data under root. The directory is
+// created if it does not exist.
+func NewLocalBackend(root string) (*LocalBackend, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &LocalBackend{root: root}, nil
+}
+
+func (l *LocalBackend) dir(key, version string) string {
+	dgst := sha256.Sum256([]byte(version + "\x00" + key))
+	return filepath.Join(l.root, hex.EncodeToString(dgst[:]))
+}
+
+// Lookup looks up keys saved without a version.
+func (l *LocalBackend) Lookup(ctx context.Context, keys ...string) (*Entry, error) {
+	return l.LookupVersion(ctx, defaultVersion, keys...)
+}
+
+func (l *LocalBackend) LookupVersion(ctx context.Context, version string, keys ...string) (*Entry, error) {
+	dirs, err := os.ReadDir(l.root)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	entries := make([]localEntry, 0, len(dirs))
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dt, err := os.ReadFile(filepath.Join(l.root, d.Name(), localEntryFile))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // not committed
+			}
+			return nil, errors.WithStack(err)
+		}
+		var le localEntry
+		if err := json.Unmarshal(dt, &le); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse entry %s", d.Name())
+		}
+		if le.Version == version {
+			entries = append(entries, le)
+		}
+	}
+
+	for _, k := range keys {
+		var match *localEntry
+		for i, le := range entries {
+			if le.Key == k {
+				match = &entries[i]
+				break
+			}
+			if strings.HasPrefix(le.Key, k) && (match == nil || le.CreatedAt.After(match.CreatedAt)) {
+				match = &entries[i]
+			}
+		}
+		if match != nil {
+			return NewEntry(match.Key, "", &localSource{
+				path: filepath.Join(l.dir(match.Key, version), localDataFile),
+			}), nil
+		}
+	}
+	return nil, nil
+}
+
+func (l *LocalBackend) LookupExact(ctx context.Context, version, key string) (*Entry, error) {
+	dir := l.dir(key, version)
+	if _, err := os.Stat(filepath.Join(dir, localEntryFile)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil // not committed
+		}
+		return nil, errors.WithStack(err)
+	}
+	return NewEntry(key, "", &localSource{path: filepath.Join(dir, localDataFile)}), nil
+}
+
+// Reserve reserves key without a version.
+func (l *LocalBackend) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return l.ReserveVersion(ctx, key, defaultVersion)
+}
+
+func (l *LocalBackend) ReserveVersion(ctx context.Context, key, version string) (*Reservation, error) {
+	dir := l.dir(key, version)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, errors.Wrapf(os.ErrExist, "cache key %s already exists", key)
+		}
+		return nil, errors.WithStack(err)
+	}
+	return &Reservation{Key: key, Version: version, ID: dir}, nil
+}
+
+func (l *LocalBackend) Upload(ctx context.Context, r *Reservation, b Blob) error {
+	f, err := os.Create(filepath.Join(r.ID, localDataFile))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(b, 0, b.Size())); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
+
+func (l *LocalBackend) Commit(ctx context.Context, r *Reservation, size int64) error {
+	fi, err := os.Stat(filepath.Join(r.ID, localDataFile))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if fi.Size() != size {
+		return errors.Errorf("invalid size %d for %s, uploaded %d", size, r.Key, fi.Size())
+	}
+	dt, err := json.Marshal(localEntry{
+		Key:       r.Key,
+		Version:   r.Version,
+		Size:      size,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// rename makes the entry visible atomically
+	tmp := filepath.Join(r.ID, localEntryFile+".tmp")
+	if err := os.WriteFile(tmp, dt, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, filepath.Join(r.ID, localEntryFile)))
+}
+
+type localSource struct {
+	path string
+}
+
+func (s *localSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &readCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+func (s *localSource) Size(ctx context.Context) (int64, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return fi.Size(), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
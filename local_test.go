@@ -0,0 +1,197 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalBackend(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+
+	b, err := NewLocalBackend(dir)
+	require.NoError(t, err)
+	c, err := NewWithBackend(b, Opt{})
+	require.NoError(t, err)
+
+	ce, err := c.Load(ctx, "partial-")
+	require.NoError(t, err)
+	require.Nil(t, ce)
+
+	for _, k := range []string{"foo22", "fo", "foo1"} {
+		err := c.Save(ctx, "partial-"+k, NewBlob([]byte(k)))
+		require.NoError(t, err)
+	}
+
+	err = c.Save(ctx, "partial-fo", NewBlob([]byte("again")))
+	require.Error(t, err)
+	require.True(t, errors.Is(err, os.ErrExist))
+
+	// reserved but not committed entries are not visible
+	r, err := b.Reserve(ctx, "partial-foo3")
+	require.NoError(t, err)
+	require.NoError(t, b.Upload(ctx, r, NewBlob([]byte("foo3"))))
+
+	// new instance over the same directory sees the same entries
+	b2, err := NewLocalBackend(dir)
+	require.NoError(t, err)
+	c2, err := NewWithBackend(b2, Opt{})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		keys []string
+		exp  string
+	}{
+		{[]string{"partial-foo"}, "partial-foo1"},
+		{[]string{"partial-"}, "partial-foo1"},
+		{[]string{"partial-fo"}, "partial-fo"},
+		{[]string{"partial-foo2"}, "partial-foo22"},
+		{[]string{"partial-foo3", "partial-foo2"}, "partial-foo22"},
+		{[]string{"partial-foo3"}, ""},
+	} {
+		ce, err := c2.Load(ctx, tc.keys...)
+		require.NoError(t, err)
+		if tc.exp == "" {
+			require.Nil(t, ce, "keys %v", tc.keys)
+			continue
+		}
+		require.NotNil(t, ce, "keys %v", tc.keys)
+		require.Equal(t, tc.exp, ce.Key, "keys %v", tc.keys)
+	}
+
+	require.NoError(t, b.Commit(ctx, r, 4))
+	ce, err = c2.Load(ctx, "partial-foo")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	require.Equal(t, "partial-foo3", ce.Key)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	require.Equal(t, "foo3", buf.String())
+
+	rac := ce.Download(ctx)
+	dt := make([]byte, 2)
+	n, err := rac.ReadAt(dt, 2)
+	require.NoError(t, err)
+	require.Equal(t, "o3", string(dt[:n]))
+	n, err = rac.ReadAt(dt, 1)
+	require.NoError(t, err)
+	require.Equal(t, "oo", string(dt[:n]))
+	require.NoError(t, rac.Close())
+}
+
+func TestLocalBackendMutable(t *testing.T) {
+	ctx := context.TODO()
+
+	b, err := NewLocalBackend(t.TempDir())
+	require.NoError(t, err)
+	c, err := NewWithBackend(b, Opt{})
+	require.NoError(t, err)
+
+	// reserve key but don't do anything, as if crashed
+	_, err = c.reserve(ctx, "mutable#1")
+	require.NoError(t, err)
+
+	count := 0
+	err = c.SaveMutable(ctx, "mutable", 3*time.Second, func(ce *Entry) (Blob, error) {
+		require.Nil(t, ce)
+		count++
+		return NewBlob([]byte("123")), nil
+	})
+	require.NoError(t, err)
+	require.True(t, count > 1)
+
+	err = c.SaveMutable(ctx, "mutable", 3*time.Second, func(ce *Entry) (Blob, error) {
+		require.NotNil(t, ce)
+		require.Equal(t, "mutable#2", ce.Key)
+		buf := &bytes.Buffer{}
+		require.NoError(t, ce.WriteTo(ctx, buf))
+		return NewBlob(append(buf.Bytes(), []byte("456")...)), nil
+	})
+	require.NoError(t, err)
+
+	ce, err := c.Load(ctx, "mutable")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	require.Equal(t, fmt.Sprintf("mutable#%d", 3), ce.Key)
+	buf := &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	require.Equal(t, "123456", buf.String())
+}
+
+func TestLocalBackendVersion(t *testing.T) {
+	ctx := context.TODO()
+	b, err := NewLocalBackend(t.TempDir())
+	require.NoError(t, err)
+	c, err := NewWithBackend(b, Opt{})
+	require.NoError(t, err)
+	cv := c.WithVersion("v1")
+
+	// the same key can be saved for every version
+	require.NoError(t, c.Save(ctx, "foo", NewBlob([]byte("default"))))
+	require.NoError(t, cv.Save(ctx, "foo", NewBlob([]byte("v1"))))
+
+	for _, c := range []*Cache{c, cv, c.WithVersion("v2")} {
+		ce, err := c.Load(ctx, "foo")
+		require.NoError(t, err)
+		if c.opt.Version == "v2" {
+			require.Nil(t, ce)
+			continue
+		}
+		require.NotNil(t, ce)
+		buf := &bytes.Buffer{}
+		require.NoError(t, ce.WriteTo(ctx, buf))
+		exp := "default"
+		if c.opt.Version != "" {
+			exp = c.opt.Version
+		}
+		require.Equal(t, exp, buf.String())
+	}
+
+	// plain Backend calls use the default version
+	ce, err := b.Lookup(ctx, "foo")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	buf := &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	require.Equal(t, "default", buf.String())
+}
+
+func TestLocalBackendLookupExact(t *testing.T) {
+	ctx := context.TODO()
+	b, err := NewLocalBackend(t.TempDir())
+	require.NoError(t, err)
+	c, err := NewWithBackend(b, Opt{})
+	require.NoError(t, err)
+
+	require.NoError(t, c.Save(ctx, "foo-1", NewBlob([]byte("foo1"))))
+	ce, err := b.LookupExact(ctx, defaultVersion, "foo-")
+	require.NoError(t, err)
+	require.Nil(t, ce)
+	ce, err = b.LookupExact(ctx, "v1", "foo-1")
+	require.NoError(t, err)
+	require.Nil(t, ce)
+
+	// reserved but not committed entries are not visible
+	r, err := b.Reserve(ctx, "foo-2")
+	require.NoError(t, err)
+	require.NoError(t, b.Upload(ctx, r, NewBlob([]byte("foo2"))))
+	ce, err = b.LookupExact(ctx, defaultVersion, "foo-2")
+	require.NoError(t, err)
+	require.Nil(t, ce)
+
+	ce, err = c.loadExact(ctx, b, "foo-1")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	require.Equal(t, "foo-1", ce.Key)
+	buf := &bytes.Buffer{}
+	require.NoError(t, ce.WriteTo(ctx, buf))
+	require.Equal(t, "foo1", buf.String())
+}
@@ -0,0 +1,127 @@
+package actionscache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// legacyLogger forwards to Log for clients that don't set Opt.Logger
+var legacyLogger = slog.New(&logShimHandler{})
+
+// logShimHandler formats records as "msg key=value ..." lines for Log
+type logShimHandler struct {
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *logShimHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *logShimHandler) Handle(_ context.Context, r slog.Record) error {
+	var sb strings.Builder
+	sb.WriteString(r.Message)
+	write := func(prefix string, a slog.Attr) {
+		fmt.Fprintf(&sb, " %s%s=%v", prefix, a.Key, a.Value.Resolve())
+	}
+	for _, a := range h.attrs {
+		write("", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		write(h.prefix, a)
+		return true
+	})
+	Log("%s", sb.String())
+	return nil
+}
+
+func (h *logShimHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *logShimHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+func newLogger(opt Opt, attrs ...any) *slog.Logger {
+	l := opt.Logger
+	if l == nil {
+		l = legacyLogger
+	}
+	return l.With(attrs...)
+}
+
+func (c *Cache) log() *slog.Logger {
+	if c.logger == nil {
+		return newLogger(c.opt)
+	}
+	return c.logger
+}
+
+func (ce *Entry) log() *slog.Logger {
+	l := ce.logger
+	if l == nil {
+		l = legacyLogger
+	}
+	return l.With("key", ce.Key, "scope", ce.Scope)
+}
+
+// sensitiveParams are query parameters of signed URLs that grant access
+var sensitiveParams = map[string]struct{}{
+	"sig":                  {},
+	"signature":            {},
+	"token":                {},
+	"x-amz-signature":      {},
+	"x-amz-credential":     {},
+	"x-amz-security-token": {},
+	"x-goog-signature":     {},
+	"x-goog-credential":    {},
+}
+
+// redactURL removes credentials from u so that it can be logged
+func redactURL(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil || pu.Host == "" {
+		return u
+	}
+	if pu.User != nil {
+		pu.User = url.User("REDACTED")
+	}
+	if pu.RawQuery != "" {
+		q := pu.Query()
+		for k := range q {
+			if _, ok := sensitiveParams[strings.ToLower(k)]; ok {
+				q[k] = []string{"REDACTED"}
+			}
+		}
+		pu.RawQuery = q.Encode()
+	}
+	return pu.String()
+}
+
+var urlPattern = regexp.MustCompile(`https?://[^\s"']+`)
+
+// redactURLs redacts all URLs in s, for example in errors of the HTTP client
+func redactURLs(s string) string {
+	return urlPattern.ReplaceAllStringFunc(s, redactURL)
+}
+
+func errAttr(err error) slog.Attr {
+	return slog.String("error", redactURLs(err.Error()))
+}
+
+func rangeAttr(off, n int64) slog.Attr {
+	return slog.String("range", fmt.Sprintf("%d-%d", off, off+n-1))
+}
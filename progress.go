@@ -0,0 +1,199 @@
+package actionscache
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Phase is the current step of a transfer reported with Progress
+type Phase string
+
+const (
+	PhaseReserve  Phase = "reserve"
+	PhaseUpload   Phase = "upload"
+	PhaseCommit   Phase = "commit"
+	PhaseDownload Phase = "download"
+)
+
+const defaultProgressInterval = 100 * time.Millisecond
+
+// Progress is a snapshot of a Save, SaveMutable, WriteTo or DownloadTo
+// passed to Opt.Progress.
+type Progress struct {
+	Key   string
+	Phase Phase
+	// Bytes is the amount of data transferred in the upload or download
+	// phase. Bytes of failed requests that are retried are not counted.
+	Bytes int64
+	// Total is the size of the data being transferred or -1 if not known.
+	Total int64
+	// Chunks is the number of completed chunks out of TotalChunks. Both are
+	// zero if the data is not transferred in chunks.
+	Chunks      int
+	TotalChunks int
+	// Retries is the number of requests that were retried.
+	Retries int
+	// Done is set on the last report of the operation. Err is set if the
+	// operation failed.
+	Done bool
+	Err  error
+}
+
+type progressConfig struct {
+	f        func(Progress)
+	interval time.Duration
+}
+
+// progress tracks a single operation and reports it at most once per interval.
+// Phase changes and the final report are never skipped. All methods are safe
+// to call on a nil progress.
+type progress struct {
+	cfg  progressConfig
+	mu   sync.Mutex
+	p    Progress
+	last time.Time
+}
+
+type progressKey struct{}
+
+func (c *Cache) progress() progressConfig {
+	return progressConfig{f: c.opt.Progress, interval: c.opt.ProgressInterval}
+}
+
+func (cfg progressConfig) start(key string) *progress {
+	if cfg.f == nil {
+		return nil
+	}
+	if cfg.interval <= 0 {
+		cfg.interval = defaultProgressInterval
+	}
+	return &progress{cfg: cfg, p: Progress{Key: key, Total: -1}}
+}
+
+func withProgress(ctx context.Context, p *progress) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+func progressFrom(ctx context.Context) *progress {
+	p, _ := ctx.Value(progressKey{}).(*progress)
+	return p
+}
+
+// report is called with the lock held
+func (p *progress) report(force bool) {
+	now := time.Now()
+	if !force && now.Sub(p.last) < p.cfg.interval {
+		return
+	}
+	p.last = now
+	p.cfg.f(p.p)
+}
+
+func (p *progress) update(force bool, f func(*Progress)) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.p.Done {
+		return
+	}
+	f(&p.p)
+	p.report(force)
+}
+
+// phase starts a new phase of the operation for key
+func (p *progress) phase(phase Phase, key string, total int64) {
+	p.update(true, func(pr *Progress) {
+		*pr = Progress{Key: key, Phase: phase, Total: total, Retries: pr.Retries}
+	})
+}
+
+func (p *progress) chunks(n int) {
+	p.update(false, func(pr *Progress) {
+		pr.TotalChunks = n
+	})
+}
+
+func (p *progress) add(n int64) {
+	if n == 0 {
+		return
+	}
+	p.update(false, func(pr *Progress) {
+		pr.Bytes += n
+	})
+}
+
+func (p *progress) chunk() {
+	p.update(false, func(pr *Progress) {
+		pr.Chunks++
+	})
+}
+
+func (p *progress) retry() {
+	p.update(false, func(pr *Progress) {
+		pr.Retries++
+	})
+}
+
+func (p *progress) finish(err error) {
+	p.update(true, func(pr *Progress) {
+		pr.Done = true
+		pr.Err = err
+	})
+}
+
+// progressReader counts the bytes read from r. When the reader is rewound
+// to retry a request, the bytes after the new position are subtracted again.
+type progressReader struct {
+	r   io.ReadSeeker
+	p   *progress
+	pos int64
+	max int64
+}
+
+func newProgressReader(r io.ReadSeeker, p *progress) *progressReader {
+	return &progressReader{r: r, p: p}
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.pos += int64(n)
+	if r.pos > r.max {
+		r.p.add(r.pos - r.max)
+		r.max = r.pos
+	}
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.r.Seek(offset, whence)
+	if err != nil {
+		return pos, errors.WithStack(err)
+	}
+	r.pos = pos
+	if pos < r.max {
+		r.p.add(pos - r.max)
+		r.max = pos
+	}
+	return pos, nil
+}
+
+// countReader reports the bytes read from a download stream
+type countReader struct {
+	io.Reader
+	p *progress
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.p.add(int64(n))
+	return n, err
+}
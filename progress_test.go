@@ -0,0 +1,177 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressRateLimit(t *testing.T) {
+	var reports []Progress
+	p := progressConfig{f: func(pr Progress) {
+		reports = append(reports, pr)
+	}, interval: time.Hour}.start("foo")
+
+	p.phase(PhaseUpload, "foo", 10)
+	p.chunks(2)
+	p.add(5)
+	p.chunk()
+	p.retry()
+	require.Len(t, reports, 1)
+	require.Equal(t, Progress{Key: "foo", Phase: PhaseUpload, Total: 10}, reports[0])
+
+	p.phase(PhaseCommit, "foo", 10)
+	require.Len(t, reports, 2)
+	require.Equal(t, Progress{Key: "foo", Phase: PhaseCommit, Total: 10, Retries: 1}, reports[1])
+
+	p.finish(nil)
+	p.finish(io.EOF)
+	p.add(1)
+	require.Len(t, reports, 3)
+	require.True(t, reports[2].Done)
+	require.NoError(t, reports[2].Err)
+
+	var np *progress
+	np.add(1)
+	np.finish(nil)
+	require.Nil(t, progressConfig{}.start("foo"))
+}
+
+func TestProgressReader(t *testing.T) {
+	var last Progress
+	p := progressConfig{f: func(pr Progress) {
+		last = pr
+	}, interval: time.Nanosecond}.start("foo")
+	p.phase(PhaseUpload, "foo", 10)
+
+	r := newProgressReader(bytes.NewReader([]byte("0123456789")), p)
+	_, err := io.CopyN(io.Discard, r, 6)
+	require.NoError(t, err)
+	p.finish(nil)
+	require.Equal(t, int64(6), last.Bytes)
+
+	p = progressConfig{f: func(pr Progress) {
+		last = pr
+	}}.start("foo")
+	r = newProgressReader(bytes.NewReader([]byte("0123456789")), p)
+	_, err = io.CopyN(io.Discard, r, 6)
+	require.NoError(t, err)
+	// retried requests read the data again
+	_, err = r.Seek(2, io.SeekStart)
+	require.NoError(t, err)
+	_, err = io.CopyN(io.Discard, r, 3)
+	require.NoError(t, err)
+	p.finish(nil)
+	require.Equal(t, int64(5), last.Bytes)
+
+	_, err = r.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, r)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), r.max)
+}
+
+// progressRecorder collects the reports of Opt.Progress
+type progressRecorder struct {
+	mu      sync.Mutex
+	reports []Progress
+}
+
+func (r *progressRecorder) record(p Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reports = append(r.reports, p)
+}
+
+func (r *progressRecorder) reset() []Progress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reports := r.reports
+	r.reports = nil
+	return reports
+}
+
+func phases(reports []Progress) []Phase {
+	var out []Phase
+	for _, p := range reports {
+		if len(out) == 0 || out[len(out)-1] != p.Phase {
+			out = append(out, p.Phase)
+		}
+	}
+	return out
+}
+
+func TestProgress(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		rec := &progressRecorder{}
+		c, _ := newTestCache(t, v2, Opt{
+			UploadChunkSize:   4,
+			DownloadChunkSize: 4,
+			Progress:          rec.record,
+			ProgressInterval:  time.Nanosecond,
+		})
+
+		data := []byte("0123456789")
+		require.NoError(t, c.Save(ctx, "progress", NewBlob(data)))
+		reports := rec.reset()
+		require.Equal(t, []Phase{PhaseReserve, PhaseUpload, PhaseCommit}, phases(reports))
+		var upload Progress
+		for _, p := range reports {
+			if p.Phase == PhaseUpload {
+				upload = p
+			}
+		}
+		require.Equal(t, int64(10), upload.Bytes)
+		require.Equal(t, int64(10), upload.Total)
+		require.Equal(t, 3, upload.TotalChunks)
+		require.Equal(t, 3, upload.Chunks)
+		last := reports[len(reports)-1]
+		require.True(t, last.Done)
+		require.NoError(t, last.Err)
+		require.Equal(t, "progress", last.Key)
+
+		require.Error(t, c.Save(ctx, "progress", NewBlob(data)))
+		reports = rec.reset()
+		require.True(t, reports[len(reports)-1].Done)
+		require.Error(t, reports[len(reports)-1].Err)
+
+		ce, err := c.Load(ctx, "progress")
+		require.NoError(t, err)
+		require.Empty(t, rec.reset())
+
+		buf := &bytes.Buffer{}
+		require.NoError(t, ce.WriteTo(ctx, buf))
+		require.Equal(t, data, buf.Bytes())
+		reports = rec.reset()
+		require.Equal(t, []Phase{PhaseDownload}, phases(reports))
+		last = reports[len(reports)-1]
+		require.True(t, last.Done)
+		require.Equal(t, int64(10), last.Bytes)
+		require.Equal(t, int64(10), last.Total)
+
+		wa := make(writerAt, len(data))
+		require.NoError(t, ce.DownloadTo(ctx, wa, DownloadOpt{}))
+		reports = rec.reset()
+		last = reports[len(reports)-1]
+		require.True(t, last.Done)
+		require.Equal(t, int64(10), last.Bytes)
+		require.Equal(t, 3, last.Chunks)
+		require.Equal(t, 3, last.TotalChunks)
+
+		err = c.SaveMutable(ctx, "mutable", 10*time.Second, func(old *Entry) (Blob, error) {
+			return NewBlob(data), nil
+		})
+		require.NoError(t, err)
+		reports = rec.reset()
+		require.Contains(t, phases(reports), PhaseUpload)
+		last = reports[len(reports)-1]
+		require.True(t, last.Done)
+		require.Equal(t, "mutable#1", last.Key)
+	})
+}
@@ -0,0 +1,184 @@
+package actionscache
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rateLimitChunk is the largest read that is throttled at once so that
+// transfers stay smooth at low limits
+const rateLimitChunk = 32 * 1024
+
+var defaultRateLimiter = NewRateLimiter(0)
+
+// DefaultRateLimiter returns the limiter applied to transfers of all Cache
+// instances in addition to Opt.RateLimiter. It does not limit bandwidth
+// unless SetLimit is called.
+func DefaultRateLimiter() *RateLimiter {
+	return defaultRateLimiter
+}
+
+// RateLimiter limits the bandwidth of uploads and downloads with a token
+// bucket. The bucket holds up to one second worth of data.
+type RateLimiter struct {
+	mu      sync.Mutex
+	limit   int64
+	tokens  float64
+	last    time.Time
+	changed chan struct{}
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSecond bytes to be
+// transferred per second. A limit of zero or less does not limit bandwidth.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{limit: bytesPerSecond, changed: make(chan struct{})}
+}
+
+// SetLimit changes the bandwidth limit. Transfers that are running pick up the
+// new limit immediately.
+func (l *RateLimiter) SetLimit(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.limit = bytesPerSecond
+	if l.tokens > float64(l.limit) {
+		l.tokens = float64(l.limit)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Limit returns the current limit in bytes per second.
+func (l *RateLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *RateLimiter) limited() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit > 0
+}
+
+// refill is called with the lock held
+func (l *RateLimiter) refill(now time.Time) {
+	if l.limit <= 0 {
+		l.last = time.Time{}
+		return
+	}
+	if l.last.IsZero() {
+		l.tokens = float64(l.limit)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+		if l.tokens > float64(l.limit) {
+			l.tokens = float64(l.limit)
+		}
+	}
+	l.last = now
+}
+
+// wait blocks until n bytes may be transferred. Reads larger than the bucket
+// are allowed once it is full and leave it in debt.
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		if l.limit <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		l.refill(time.Now())
+		need := min(float64(n), float64(l.limit))
+		if l.tokens >= need {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+		d := time.Duration((need - l.tokens) / float64(l.limit) * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return errors.WithStack(ctx.Err())
+		case <-changed:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
+// rateLimitReader throttles reads from r with all limiters
+type rateLimitReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+func newRateLimitReader(ctx context.Context, r io.Reader, limiters []*RateLimiter) *rateLimitReader {
+	return &rateLimitReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (r *rateLimitReader) Read(p []byte) (int, error) {
+	for _, l := range r.limiters {
+		if l.limited() {
+			if len(p) > rateLimitChunk {
+				p = p[:rateLimitChunk]
+			}
+			break
+		}
+	}
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		if err := l.wait(r.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (r *rateLimitReader) Seek(offset int64, whence int) (int64, error) {
+	s, ok := r.r.(io.Seeker)
+	if !ok {
+		return 0, errors.Errorf("reader does not support seeking")
+	}
+	return s.Seek(offset, whence)
+}
+
+// rateLimitSource throttles the data read from src
+type rateLimitSource struct {
+	src      EntrySource
+	limiters []*RateLimiter
+}
+
+func (s *rateLimitSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	rc, err := s.src.Open(ctx, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{Reader: newRateLimitReader(ctx, rc, s.limiters), Closer: rc}, nil
+}
+
+func (s *rateLimitSource) Size(ctx context.Context) (int64, error) {
+	return s.src.Size(ctx)
+}
+
+func (c *Cache) rateLimiters() []*RateLimiter {
+	limiters := []*RateLimiter{defaultRateLimiter}
+	if c.opt.RateLimiter != nil {
+		limiters = append(limiters, c.opt.RateLimiter)
+	}
+	return limiters
+}
@@ -0,0 +1,78 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.TODO()
+	l := NewRateLimiter(64 * 1024)
+	data := bytes.Repeat([]byte("a"), 96*1024)
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, newRateLimitReader(ctx, bytes.NewReader(data), []*RateLimiter{l}))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	// the first second worth of data is not delayed
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	require.Less(t, time.Since(start), 2*time.Second)
+
+	// nil and unlimited limiters don't block
+	start = time.Now()
+	_, err = io.Copy(io.Discard, newRateLimitReader(ctx, bytes.NewReader(data), []*RateLimiter{nil, NewRateLimiter(0)}))
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	ctx := context.TODO()
+	l := NewRateLimiter(1024)
+	r := newRateLimitReader(ctx, bytes.NewReader(make([]byte, 8*1024)), []*RateLimiter{l})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.SetLimit(0)
+	}()
+	start := time.Now()
+	_, err := io.CopyBuffer(struct{ io.Writer }{io.Discard}, r, make([]byte, 1024))
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, int64(0), l.Limit())
+
+	l.SetLimit(1)
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = io.CopyBuffer(struct{ io.Writer }{io.Discard}, newRateLimitReader(ctx, bytes.NewReader(make([]byte, 10)), []*RateLimiter{l}), make([]byte, 2))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRateLimit(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, _ := newTestCache(t, v2, Opt{
+			RateLimiter: NewRateLimiter(32 * 1024),
+		})
+
+		data := bytes.Repeat([]byte("0123456789abcdef"), 3*1024)
+		start := time.Now()
+		require.NoError(t, c.Save(ctx, "limited", NewBlob(data)))
+		require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+		ce, err := c.Load(ctx, "limited")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+
+		start = time.Now()
+		buf := &bytes.Buffer{}
+		require.NoError(t, ce.WriteTo(ctx, buf))
+		require.Equal(t, data, buf.Bytes())
+		require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	})
+}
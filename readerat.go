@@ -1,7 +1,12 @@
 package actionscache
 
 import (
+	"context"
 	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
 )
 
 type ReaderAtCloser interface {
@@ -9,81 +14,281 @@ type ReaderAtCloser interface {
 	io.Closer
 }
 
+const (
+	readerBlockSize = 1024 * 1024
+	readerMaxBlocks = 32
+	readerReadAhead = 2
+	// readerWindow bounds the range requested by a connection to the data the
+	// block cache can hold
+	readerWindow = readerMaxBlocks * readerBlockSize
+)
+
+// readerAtCloser implements random access reads over an EntrySource. Data is
+// fetched in aligned blocks that are kept in a small LRU cache. Range
+// connections are kept open after a block has been read so the following
+// block can continue on the same stream, and sequential access triggers
+// read-ahead of the next blocks.
 type readerAtCloser struct {
+	ctx    context.Context
+	cancel func()
+	src    EntrySource
+	sem    chan struct{}
+	sched  *TransferScheduler
+
+	sizeOnce sync.Once
+	size     int64
+	sizeErr  error
+
+	mu     sync.Mutex
+	blocks map[int64]*block
+	tick   int64
+	last   int64
+	conns  []*rangeConn
+	closed bool
+}
+
+type block struct {
+	done chan struct{}
+	data []byte
+	err  error
+	used int64
+}
+
+type rangeConn struct {
 	offset int64
+	end    int64
 	rc     io.ReadCloser
-	ra     io.ReaderAt
-	open   func(offset int64) (io.ReadCloser, error)
-	closed bool
 }
 
-func toReaderAtCloser(open func(offset int64) (io.ReadCloser, error)) ReaderAtCloser {
+// newReaderAtCloser returns a reader fetching up to conns blocks in parallel
+func newReaderAtCloser(ctx context.Context, src EntrySource, conns int, sched *TransferScheduler) ReaderAtCloser {
+	ctx, cancel := context.WithCancel(ctx)
 	return &readerAtCloser{
-		open: open,
+		ctx:    ctx,
+		cancel: cancel,
+		src:    src,
+		sem:    make(chan struct{}, conns),
+		sched:  sched,
+		blocks: map[int64]*block{},
+		last:   -readerBlockSize,
 	}
 }
 
-func (hrs *readerAtCloser) ReadAt(p []byte, off int64) (n int, err error) {
-	if hrs.closed {
-		return 0, io.EOF
+func (r *readerAtCloser) ReadAt(p []byte, off int64) (n int, err error) {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return 0, errors.WithStack(os.ErrClosed)
 	}
 
-	if hrs.ra != nil {
-		return hrs.ra.ReadAt(p, off)
+	r.sizeOnce.Do(func() {
+		r.size, r.sizeErr = r.src.Size(r.ctx)
+	})
+	if r.sizeErr != nil {
+		return 0, r.sizeErr
 	}
 
-	if hrs.rc == nil || off != hrs.offset {
-		if hrs.rc != nil {
-			hrs.rc.Close()
-			hrs.rc = nil
-		}
-		rc, err := hrs.open(off)
+	for n < len(p) && off < r.size {
+		start := off - off%readerBlockSize
+		b, err := r.block(start)
 		if err != nil {
-			return 0, err
+			return n, err
 		}
-		hrs.rc = rc
-	}
-	if ra, ok := hrs.rc.(io.ReaderAt); ok {
-		hrs.ra = ra
-		n, err = ra.ReadAt(p, off)
-	} else {
-		for {
-			var nn int
-			nn, err = hrs.rc.Read(p)
-			n += nn
-			p = p[nn:]
-			if nn == len(p) || err != nil {
-				break
+		nn := copy(p[n:], b.data[off-start:])
+		n += nn
+		off += int64(nn)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns the block starting at offset, fetching it if needed
+func (r *readerAtCloser) block(offset int64) (*block, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, errors.WithStack(os.ErrClosed)
+	}
+	b := r.get(offset)
+	if offset == r.last+readerBlockSize {
+		for i := int64(1); i <= readerReadAhead; i++ {
+			if o := offset + i*readerBlockSize; o < r.size {
+				r.get(o)
 			}
 		}
 	}
+	r.last = offset
+	r.mu.Unlock()
 
-	hrs.offset += int64(n)
-	return
+	select {
+	case <-b.done:
+	case <-r.ctx.Done():
+		return nil, errors.WithStack(r.ctx.Err())
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b, nil
 }
 
-func (hrs *readerAtCloser) Close() error {
-	if hrs.closed {
-		return nil
+// get returns the cached block for offset or starts fetching it. Called with
+// the lock held.
+func (r *readerAtCloser) get(offset int64) *block {
+	r.tick++
+	if b, ok := r.blocks[offset]; ok {
+		b.used = r.tick
+		return b
+	}
+	b := &block{done: make(chan struct{}), used: r.tick}
+	r.blocks[offset] = b
+	r.evict()
+	go r.fetch(b, offset)
+	return b
+}
+
+// evict removes least recently used blocks that have finished loading.
+// Called with the lock held.
+func (r *readerAtCloser) evict() {
+	for len(r.blocks) > readerMaxBlocks {
+		var (
+			oldest *block
+			key    int64
+		)
+		for k, b := range r.blocks {
+			select {
+			case <-b.done:
+			default:
+				continue
+			}
+			if oldest == nil || b.used < oldest.used {
+				oldest, key = b, k
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(r.blocks, key)
+	}
+}
+
+func (r *readerAtCloser) fetch(b *block, offset int64) {
+	defer close(b.done)
+
+	// if the previous block is loading, wait for it so this block can
+	// continue on the same connection
+	r.mu.Lock()
+	prev, ok := r.blocks[offset-readerBlockSize]
+	r.mu.Unlock()
+	if ok {
+		select {
+		case <-prev.done:
+		case <-r.ctx.Done():
+		}
+	}
+
+	select {
+	case r.sem <- struct{}{}:
+		defer func() { <-r.sem }()
+	case <-r.ctx.Done():
+		b.err = errors.WithStack(r.ctx.Err())
+		r.drop(offset, b)
+		return
+	}
+
+	if err := r.sched.acquire(r.ctx); err != nil {
+		b.err = err
+		r.drop(offset, b)
+		return
+	}
+	defer r.sched.release()
+
+	data := make([]byte, min(readerBlockSize, r.size-offset))
+	if err := r.readBlock(offset, data); err != nil {
+		b.err = err
+		r.drop(offset, b)
+		return
+	}
+	b.data = data
+}
+
+func (r *readerAtCloser) readBlock(offset int64, data []byte) error {
+	c := r.conn(offset)
+	if c != nil {
+		if _, err := io.ReadFull(c.rc, data); err == nil {
+			c.offset += int64(len(data))
+			r.release(c)
+			return nil
+		}
+		// idle connection may have been closed by the server
+		c.rc.Close()
 	}
-	hrs.closed = true
-	if hrs.rc != nil {
-		return hrs.rc.Close()
+	end := min(offset+readerWindow, r.size)
+	rc, err := r.src.Open(r.ctx, offset, end-offset)
+	if err != nil {
+		return err
 	}
+	if _, err := io.ReadFull(rc, data); err != nil {
+		rc.Close()
+		return errors.Wrapf(err, "failed to read block at offset %d", offset)
+	}
+	r.release(&rangeConn{offset: offset + int64(len(data)), end: end, rc: rc})
+	return nil
+}
 
+// drop removes a failed block so the next read tries again
+func (r *readerAtCloser) drop(offset int64, b *block) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.blocks[offset] == b {
+		delete(r.blocks, offset)
+	}
+}
+
+// conn returns an idle connection positioned at offset if there is one
+func (r *readerAtCloser) conn(offset int64) *rangeConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, c := range r.conns {
+		if c.offset == offset {
+			r.conns = append(r.conns[:i], r.conns[i+1:]...)
+			return c
+		}
+	}
 	return nil
 }
 
-type rc struct {
-	io.ReaderAt
-	offset int
+func (r *readerAtCloser) release(c *rangeConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || c.offset >= c.end {
+		c.rc.Close()
+		return
+	}
+	r.conns = append(r.conns, c)
+	if len(r.conns) > cap(r.sem) {
+		r.conns[0].rc.Close()
+		r.conns = r.conns[1:]
+	}
 }
 
-func (r *rc) Read(b []byte) (int, error) {
-	n, err := r.ReadAt(b, int64(r.offset))
-	r.offset += n
-	if n > 0 && err == io.EOF {
-		err = nil
+func (r *readerAtCloser) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.cancel()
+	var err error
+	for _, c := range r.conns {
+		if err1 := c.rc.Close(); err == nil {
+			err = err1
+		}
 	}
-	return n, err
+	r.conns = nil
+	r.blocks = nil
+	return err
 }
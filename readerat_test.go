@@ -0,0 +1,117 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+type countingSource struct {
+	bytesSource
+	opens atomic.Int64
+}
+
+func (c *countingSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	c.opens.Add(1)
+	return c.bytesSource.Open(ctx, offset, length)
+}
+
+func testData(size int) []byte {
+	dt := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(dt)
+	return dt
+}
+
+func TestReaderAtSequential(t *testing.T) {
+	data := testData(10*readerBlockSize + 123)
+	src := &countingSource{bytesSource: data}
+	rac := newReaderAtCloser(context.TODO(), src, 4, nil)
+
+	buf := &bytes.Buffer{}
+	_, err := io.Copy(buf, io.NewSectionReader(rac, 0, int64(len(data))))
+	require.NoError(t, err)
+	require.Equal(t, data, buf.Bytes())
+	require.NoError(t, rac.Close())
+
+	// sequential blocks continue on the same connections
+	require.LessOrEqual(t, src.opens.Load(), int64(4))
+}
+
+func TestReaderAtConcurrent(t *testing.T) {
+	data := testData(8*readerBlockSize + 77)
+	src := &countingSource{bytesSource: data}
+	rac := newReaderAtCloser(context.TODO(), src, 4, nil)
+	defer rac.Close()
+
+	var mu sync.Mutex
+	rnd := rand.New(rand.NewSource(2))
+	var eg errgroup.Group
+	for i := 0; i < 8; i++ {
+		eg.Go(func() error {
+			for j := 0; j < 50; j++ {
+				mu.Lock()
+				off := rnd.Int63n(int64(len(data)))
+				l := rnd.Intn(3 * readerBlockSize)
+				mu.Unlock()
+
+				p := make([]byte, l)
+				n, err := rac.ReadAt(p, off)
+				end := min(off+int64(l), int64(len(data)))
+				if end-off < int64(l) {
+					assert.ErrorIs(t, err, io.EOF)
+				} else {
+					assert.NoError(t, err)
+				}
+				assert.Equal(t, int(end-off), n)
+				assert.Equal(t, data[off:end], p[:n])
+			}
+			return nil
+		})
+	}
+	require.NoError(t, eg.Wait())
+
+	n, err := rac.ReadAt(make([]byte, 1), int64(len(data)))
+	require.Equal(t, 0, n)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+// rangeSource records the requested ranges
+type rangeSource struct {
+	bytesSource
+	mu     sync.Mutex
+	ranges [][2]int64
+}
+
+func (s *rangeSource) Open(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, [2]int64{offset, length})
+	s.mu.Unlock()
+	return s.bytesSource.Open(ctx, offset, length)
+}
+
+func TestReaderAtWindow(t *testing.T) {
+	data := testData(readerWindow + 3*readerBlockSize)
+	src := &rangeSource{bytesSource: data}
+	rac := newReaderAtCloser(context.TODO(), src, 1, nil)
+
+	buf := &bytes.Buffer{}
+	_, err := io.Copy(buf, io.NewSectionReader(rac, 0, int64(len(data))))
+	require.NoError(t, err)
+	require.Equal(t, data, buf.Bytes())
+
+	// connections don't request data past what the block cache can hold
+	require.Equal(t, [][2]int64{{0, readerWindow}, {readerWindow, 3 * readerBlockSize}}, src.ranges)
+
+	require.NoError(t, rac.Close())
+	_, err = rac.ReadAt(make([]byte, 1), 0)
+	require.ErrorIs(t, err, os.ErrClosed)
+}
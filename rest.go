@@ -1,22 +1,31 @@
 package actionscache
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
 const (
-	apiURL  = "https://api.github.com"
-	perPage = 100
+	defaultAPIURL = "https://api.github.com"
+	perPage       = 100
 )
 
 type RestAPI struct {
-	repo  string
-	token string
-	opt   Opt
+	repo   string
+	token  string
+	apiURL string
+	opt    Opt
+	log    *slog.Logger
 }
 
 type CacheKey struct {
@@ -29,17 +38,94 @@ type CacheKey struct {
 	SizeInBytes  int    `json:"size_in_bytes"`
 }
 
+// DeleteResult is returned by the delete methods of RestAPI.
+type DeleteResult struct {
+	// Deleted is the number of removed cache entries.
+	Deleted int `json:"total_count"`
+	// Caches are the removed entries. Only set by DeleteByKey.
+	Caches []CacheKey `json:"actions_caches"`
+}
+
+// RepoCacheUsage is the cache usage of a single repository.
+type RepoCacheUsage struct {
+	FullName          string `json:"full_name"`
+	ActiveCachesSize  int64  `json:"active_caches_size_in_bytes"`
+	ActiveCachesCount int    `json:"active_caches_count"`
+}
+
+// OrgCacheUsage is the total cache usage of all repositories in an
+// organization.
+type OrgCacheUsage struct {
+	TotalActiveCachesSize  int64 `json:"total_active_caches_size_in_bytes"`
+	TotalActiveCachesCount int   `json:"total_active_caches_count"`
+}
+
+// CacheUsagePolicy controls the cache storage limits of repositories. Usage
+// policies are only available on GitHub Enterprise Server.
+type CacheUsagePolicy struct {
+	RepoCacheSizeLimitGB int `json:"repo_cache_size_limit_in_gb,omitempty"`
+	// MaxRepoCacheSizeLimitGB is the highest limit repositories can set for
+	// themselves. Only used for enterprise policies.
+	MaxRepoCacheSizeLimitGB int `json:"max_repo_cache_size_limit_in_gb,omitempty"`
+}
+
 func NewRestAPI(repo, token string, opt Opt) (*RestAPI, error) {
 	opt = optsWithDefaults(opt)
+	apiURL, err := apiBaseURL(opt.APIURL, opt.RawAPIURL)
+	if err != nil {
+		return nil, err
+	}
 	return &RestAPI{
-		repo:  repo,
-		token: token,
-		opt:   opt,
+		repo:   repo,
+		token:  token,
+		apiURL: apiURL,
+		opt:    opt,
+		log:    newLogger(opt, "repo", repo),
 	}, nil
 }
 
-func (r *RestAPI) httpReq(ctx context.Context, method string, url *url.URL) (*http.Request, error) {
-	req, err := http.NewRequest(method, url.String(), nil)
+// TryEnvRestAPI returns a RestAPI for the repository of the current workflow
+// run, configured from GITHUB_REPOSITORY, GITHUB_TOKEN and GITHUB_API_URL.
+// Returns nil if token or repository are not set.
+func TryEnvRestAPI(opt Opt) (*RestAPI, error) {
+	token := os.Getenv("GITHUB_TOKEN")
+	repo := os.Getenv("GITHUB_REPOSITORY")
+	if token == "" || repo == "" {
+		return nil, nil
+	}
+	if opt.APIURL == "" {
+		opt.APIURL = os.Getenv("GITHUB_API_URL")
+	}
+	return NewRestAPI(repo, token, opt)
+}
+
+// apiBaseURL returns the REST API base URL for v. GitHub Enterprise Server
+// serves the API under /api/v3 of the instance URL, so the prefix is added if
+// v points to the root of a server that is not an API host itself. If raw is
+// set, v is used as is apart from a trailing slash.
+func apiBaseURL(v string, raw bool) (string, error) {
+	if v == "" {
+		return defaultAPIURL, nil
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid API URL %q", v)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", errors.Errorf("invalid API URL %q", v)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	if u.Path == "" && !raw && !strings.HasPrefix(u.Hostname(), "api.") {
+		u.Path = "/api/v3"
+	}
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+func (r *RestAPI) httpReq(ctx context.Context, method string, url *url.URL, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url.String(), body)
 	if err != nil {
 		return nil, err
 	}
@@ -47,9 +133,59 @@ func (r *RestAPI) httpReq(ctx context.Context, method string, url *url.URL) (*ht
 	req.Header.Set("Accept", "application/vnd.github+json")
 	req.Header.Set("Authorization", "Bearer "+r.token)
 	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	return req, nil
 }
 
+// do sends a request with optional JSON body and decodes the JSON response
+// into out if it is not nil.
+func (r *RestAPI) do(ctx context.Context, method string, u *url.URL, in, out interface{}) error {
+	var dt []byte
+	if in != nil {
+		var err error
+		dt, err = json.Marshal(in)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	resp, err := r.doWithRetries(ctx, func() (*http.Request, error) {
+		var body io.Reader
+		if dt != nil {
+			body = bytes.NewReader(dt)
+		}
+		return r.httpReq(ctx, method, u, body)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Wrapf(err, "failed to decode response for %s %s", method, u.Path)
+	}
+	return nil
+}
+
+// doWithRetries sends the request until it succeeds or fails with an error
+// that is not retryable. In addition to 429 responses, requests that hit the
+// primary or secondary GitHub API rate limits wait in the BackoffPool until
+// the limit resets. All REST API methods used by this package are idempotent
+// so they can be retried safely.
+func (r *RestAPI) doWithRetries(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	return doWithRetries(ctx, r.opt, r.log, retryOpt{
+		idempotent: true,
+		rateLimited: func(resp *http.Response) bool {
+			_, ok := rateLimitReset(resp)
+			return ok || resp.StatusCode == http.StatusTooManyRequests
+		},
+	}, newReq)
+}
+
 func (r *RestAPI) ListKeys(ctx context.Context, prefix, ref string) ([]CacheKey, error) {
 	var out []CacheKey
 	page := 1
@@ -69,7 +205,7 @@ func (r *RestAPI) ListKeys(ctx context.Context, prefix, ref string) ([]CacheKey,
 }
 
 func (r *RestAPI) listKeysPage(ctx context.Context, prefix, ref string, page int) ([]CacheKey, int, error) {
-	u, err := url.Parse(apiURL + "/repos/" + r.repo + "/actions/caches")
+	u, err := url.Parse(r.apiURL + "/repos/" + r.repo + "/actions/caches")
 	if err != nil {
 		return nil, 0, err
 	}
@@ -86,26 +222,150 @@ func (r *RestAPI) listKeysPage(ctx context.Context, prefix, ref string, page int
 	}
 	u.RawQuery = q.Encode()
 
-	req, err := r.httpReq(ctx, "GET", u)
-	if err != nil {
+	var keys struct {
+		Total  int        `json:"total_count"`
+		Caches []CacheKey `json:"actions_caches"`
+	}
+	if err := r.do(ctx, "GET", u, nil, &keys); err != nil {
 		return nil, 0, err
 	}
+	return keys.Caches, keys.Total, nil
+}
 
-	resp, err := r.opt.Client.Do(req)
+// DeleteByKey deletes all cache entries with the exact key. If ref is not
+// empty, only entries in that ref are deleted. Deleting a key that does not
+// exist is not an error.
+func (r *RestAPI) DeleteByKey(ctx context.Context, key, ref string) (*DeleteResult, error) {
+	u, err := url.Parse(r.apiURL + "/repos/" + r.repo + "/actions/caches")
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("key", key)
+	if ref != "" {
+		q.Set("ref", ref)
 	}
+	u.RawQuery = q.Encode()
 
-	dec := json.NewDecoder(resp.Body)
-	var keys struct {
-		Total  int        `json:"total_count"`
-		Caches []CacheKey `json:"actions_caches"`
+	var res DeleteResult
+	if err := r.do(ctx, "DELETE", u, nil, &res); err != nil {
+		var he HTTPError
+		if errors.As(err, &he) && he.StatusCode == http.StatusNotFound {
+			return &DeleteResult{}, nil
+		}
+		return nil, err
 	}
+	return &res, nil
+}
 
-	if err := dec.Decode(&keys); err != nil {
-		return nil, 0, err
+// DeleteByID deletes a single cache entry by its ID.
+func (r *RestAPI) DeleteByID(ctx context.Context, id int) (*DeleteResult, error) {
+	u, err := url.Parse(r.apiURL + "/repos/" + r.repo + "/actions/caches/" + strconv.Itoa(id))
+	if err != nil {
+		return nil, err
 	}
+	if err := r.do(ctx, "DELETE", u, nil, nil); err != nil {
+		return nil, err
+	}
+	return &DeleteResult{Deleted: 1}, nil
+}
 
-	resp.Body.Close()
-	return keys.Caches, keys.Total, nil
+// Usage returns the cache usage of the repository.
+func (r *RestAPI) Usage(ctx context.Context) (*RepoCacheUsage, error) {
+	u, err := url.Parse(r.apiURL + "/repos/" + r.repo + "/actions/cache/usage")
+	if err != nil {
+		return nil, err
+	}
+	var usage RepoCacheUsage
+	if err := r.do(ctx, "GET", u, nil, &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// OrgUsage returns the total cache usage of an organization.
+func (r *RestAPI) OrgUsage(ctx context.Context, org string) (*OrgCacheUsage, error) {
+	u, err := url.Parse(r.apiURL + "/orgs/" + org + "/actions/cache/usage")
+	if err != nil {
+		return nil, err
+	}
+	var usage OrgCacheUsage
+	if err := r.do(ctx, "GET", u, nil, &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// OrgUsageByRepository returns the cache usage of every repository in an
+// organization that has active caches.
+func (r *RestAPI) OrgUsageByRepository(ctx context.Context, org string) ([]RepoCacheUsage, error) {
+	var out []RepoCacheUsage
+	for page := 1; ; page++ {
+		u, err := url.Parse(r.apiURL + "/orgs/" + org + "/actions/cache/usage-by-repository")
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("per_page", strconv.Itoa(perPage))
+		q.Set("page", strconv.Itoa(page))
+		u.RawQuery = q.Encode()
+
+		var res struct {
+			Total  int              `json:"total_count"`
+			Usages []RepoCacheUsage `json:"repository_cache_usages"`
+		}
+		if err := r.do(ctx, "GET", u, nil, &res); err != nil {
+			return nil, err
+		}
+		out = append(out, res.Usages...)
+		if res.Total <= page*perPage || len(res.Usages) == 0 {
+			break
+		}
+	}
+	return out, nil
+}
+
+// UsagePolicy returns the cache usage policy of the repository.
+func (r *RestAPI) UsagePolicy(ctx context.Context) (*CacheUsagePolicy, error) {
+	u, err := url.Parse(r.apiURL + "/repos/" + r.repo + "/actions/cache/usage-policy")
+	if err != nil {
+		return nil, err
+	}
+	var p CacheUsagePolicy
+	if err := r.do(ctx, "GET", u, nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// SetUsagePolicy sets the cache size limit of the repository.
+func (r *RestAPI) SetUsagePolicy(ctx context.Context, limitGB int) error {
+	u, err := url.Parse(r.apiURL + "/repos/" + r.repo + "/actions/cache/usage-policy")
+	if err != nil {
+		return err
+	}
+	return r.do(ctx, "PATCH", u, CacheUsagePolicy{RepoCacheSizeLimitGB: limitGB}, nil)
+}
+
+// EnterpriseUsagePolicy returns the cache usage policy of an enterprise.
+func (r *RestAPI) EnterpriseUsagePolicy(ctx context.Context, enterprise string) (*CacheUsagePolicy, error) {
+	u, err := url.Parse(r.apiURL + "/enterprises/" + enterprise + "/actions/cache/usage-policy")
+	if err != nil {
+		return nil, err
+	}
+	var p CacheUsagePolicy
+	if err := r.do(ctx, "GET", u, nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// SetEnterpriseUsagePolicy sets the cache usage policy of an enterprise. Zero
+// fields are not changed.
+func (r *RestAPI) SetEnterpriseUsagePolicy(ctx context.Context, enterprise string, p CacheUsagePolicy) error {
+	u, err := url.Parse(r.apiURL + "/enterprises/" + enterprise + "/actions/cache/usage-policy")
+	if err != nil {
+		return err
+	}
+	return r.do(ctx, "PATCH", u, p, nil)
 }
@@ -0,0 +1,205 @@
+package actionscache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIBaseURL(t *testing.T) {
+	for in, exp := range map[string]string{
+		"":                                  "https://api.github.com",
+		"https://api.github.com":            "https://api.github.com",
+		"https://api.github.com/":           "https://api.github.com",
+		"https://ghe.example.com":           "https://ghe.example.com/api/v3",
+		"https://ghe.example.com/":          "https://ghe.example.com/api/v3",
+		"https://ghe.example.com/api/v3":    "https://ghe.example.com/api/v3",
+		"https://ghe.example.com/api/v3/":   "https://ghe.example.com/api/v3",
+		"https://api.octocorp.ghe.com":      "https://api.octocorp.ghe.com",
+		"http://127.0.0.1:8080":             "http://127.0.0.1:8080/api/v3",
+		"http://127.0.0.1:8080/custom/path": "http://127.0.0.1:8080/custom/path",
+	} {
+		u, err := apiBaseURL(in, false)
+		require.NoError(t, err, in)
+		require.Equal(t, exp, u, in)
+	}
+
+	for in, exp := range map[string]string{
+		"http://127.0.0.1:8080":          "http://127.0.0.1:8080",
+		"http://127.0.0.1:8080/":         "http://127.0.0.1:8080",
+		"https://ghe.example.com/api/v3": "https://ghe.example.com/api/v3",
+	} {
+		u, err := apiBaseURL(in, true)
+		require.NoError(t, err, in)
+		require.Equal(t, exp, u, in)
+	}
+
+	_, err := apiBaseURL("ghe.example.com", false)
+	require.Error(t, err)
+}
+
+func TestRestAPIRetries(t *testing.T) {
+	ctx := context.TODO()
+
+	var calls int
+	var handler func(w http.ResponseWriter, r *http.Request)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		handler(w, r)
+	}))
+	defer srv.Close()
+
+	api, err := NewRestAPI("owner/repo", "token", Opt{
+		APIURL:      srv.URL,
+		BackoffPool: &BackoffPool{},
+		Timeout:     10 * time.Second,
+	})
+	require.NoError(t, err)
+
+	usage := func(w http.ResponseWriter) {
+		w.Write([]byte(`{"full_name":"owner/repo","active_caches_size_in_bytes":10,"active_caches_count":1}`))
+	}
+
+	for name, fail := range map[string]func(w http.ResponseWriter){
+		"server-error": func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		"primary-rate-limit": func(w http.ResponseWriter) {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Second).Unix(), 10))
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message":"API rate limit exceeded"}`))
+		},
+		"secondary-rate-limit": func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message":"You have exceeded a secondary rate limit"}`))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			calls = 0
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/api/v3/repos/owner/repo/actions/cache/usage", r.URL.Path)
+				if calls == 1 {
+					fail(w)
+					return
+				}
+				usage(w)
+			}
+			u, err := api.Usage(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 2, calls)
+			require.Equal(t, 1, u.ActiveCachesCount)
+		})
+	}
+
+	// server errors are retried without delaying other users of the pool
+	calls = 0
+	handler = func(w http.ResponseWriter, r *http.Request) {
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		usage(w)
+	}
+	_, err = api.Usage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+	api.opt.BackoffPool.mu.Lock()
+	require.Nil(t, api.opt.BackoffPool.timer)
+	api.opt.BackoffPool.mu.Unlock()
+
+	// a successful response resets the backoff of a 429 without reset time so
+	// the next rate limited request only waits for the minimum delay
+	for i := range 2 {
+		calls = 0
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			if calls == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			usage(w)
+		}
+		start := time.Now()
+		_, err = api.Usage(ctx)
+		require.NoError(t, err, i)
+		require.Equal(t, 2, calls, i)
+		require.Less(t, time.Since(start), 1500*time.Millisecond, i)
+		api.opt.BackoffPool.mu.Lock()
+		require.Nil(t, api.opt.BackoffPool.timer, i)
+		require.Equal(t, time.Duration(0), api.opt.BackoffPool.backoff, i)
+		api.opt.BackoffPool.mu.Unlock()
+	}
+
+	calls = 0
+	handler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"Not Found","documentation_url":"https://docs.github.com/rest"}`))
+	}
+	_, err = api.Usage(ctx)
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+	var he HTTPError
+	require.True(t, errors.As(err, &he), "error was %+v", err)
+	require.Equal(t, http.StatusNotFound, he.StatusCode)
+	var gae GithubAPIError
+	require.True(t, errors.As(err, &gae), "error was %+v", err)
+	require.Equal(t, "Not Found", gae.Message)
+	require.Equal(t, "https://docs.github.com/rest", gae.DocumentationURL)
+
+	// rate limit that does not reset before timeout fails without waiting
+	calls = 0
+	handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message":"API rate limit exceeded"}`))
+	}
+	_, err = api.ListKeys(ctx, "", "")
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+	require.True(t, errors.As(err, &he), "error was %+v", err)
+	require.Equal(t, http.StatusForbidden, he.StatusCode)
+
+	handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`not json`))
+	}
+	_, err = api.ListKeys(ctx, "", "")
+	require.ErrorContains(t, err, "failed to decode response")
+}
+
+func TestRestAPIRetryTransportError(t *testing.T) {
+	ctx := context.TODO()
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			// drop the connection without a response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"full_name":"owner/repo","active_caches_size_in_bytes":10,"active_caches_count":1}`))
+	}))
+	defer srv.Close()
+
+	api, err := NewRestAPI("owner/repo", "token", Opt{
+		APIURL:      srv.URL,
+		BackoffPool: &BackoffPool{},
+		RetryPolicy: &ExponentialRetryPolicy{MinBackoff: 10 * time.Millisecond},
+		Timeout:     10 * time.Second,
+	})
+	require.NoError(t, err)
+	u, err := api.Usage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+	require.Equal(t, 1, u.ActiveCachesCount)
+}
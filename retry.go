@@ -2,28 +2,117 @@ package actionscache
 
 import (
 	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
-const maxBackoff = time.Second * 90
-const minBackoff = time.Second * 1
+const defaultMaxBackoff = time.Second * 90
+const defaultMinBackoff = time.Second * 1
 
 var defaultBackoffPool = &BackoffPool{}
 
+const (
+	defaultRetryMinBackoff = 500 * time.Millisecond
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+// RetryPolicy decides which failed idempotent requests are retried. Requests
+// rejected with 429 always back off through the BackoffPool instead.
+type RetryPolicy interface {
+	// Retry is called after attempt number attempt of req failed, either with
+	// a transport error err or with the response resp. It returns whether the
+	// request is retried and how long to wait before the next attempt.
+	Retry(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool)
+}
+
+// ExponentialRetryPolicy retries transport errors and 500, 502, 503 and 504
+// responses with jittered exponential backoff. It is the default RetryPolicy.
+type ExponentialRetryPolicy struct {
+	// MinBackoff is the delay before the first retry. Defaults to 500ms.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Defaults to 30s.
+	MaxBackoff time.Duration
+	// MaxAttempts limits the number of attempts. Zero retries until
+	// Opt.Timeout is reached.
+	MaxAttempts int
+}
+
+func (p *ExponentialRetryPolicy) Retry(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	if err != nil {
+		// cancelled requests are not retried
+		if req.Context().Err() != nil {
+			return 0, false
+		}
+	} else if !retryableStatus(resp.StatusCode) {
+		return 0, false
+	}
+	minDelay := p.MinBackoff
+	if minDelay <= 0 {
+		minDelay = defaultRetryMinBackoff
+	}
+	maxDelay := p.MaxBackoff
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxBackoff
+	}
+	d := minDelay
+	for i := 1; i < attempt && d < maxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, maxDelay)
+	// wait between half and the full backoff so that clients don't retry in sync
+	return d/2 + rand.N(d/2+1), true
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// BackoffPool delays requests of all clients sharing it after the server
+// rejected a request with a rate limit error. Without a time from the server
+// the delay doubles on every rate limited request from MinBackoff up to
+// MaxBackoff.
 type BackoffPool struct {
+	// MinBackoff is the first delay. Defaults to 1s.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay. It does not limit times sent by the server.
+	// Defaults to 90s.
+	MaxBackoff time.Duration
+
 	mu      sync.Mutex
 	queue   []chan struct{}
 	timer   *time.Timer
 	backoff time.Duration
 	target  time.Time
+	// fixed is set while waiting for a time sent by the server or by another
+	// process sharing the pool
+	fixed  bool
+	shared *sharedBackoff
 }
 
 func (b *BackoffPool) Wait(ctx context.Context, timeout time.Duration) error {
+	return b.wait(ctx, timeout, legacyLogger)
+}
+
+func (b *BackoffPool) wait(ctx context.Context, timeout time.Duration, log *slog.Logger) error {
+	shared, err := b.shared.load()
+	if err != nil {
+		log.Warn("failed to read shared backoff", "path", b.shared.path, errAttr(err))
+	}
 	b.mu.Lock()
-	if b.timer == nil {
+	if b.timer == nil && !b.follow(shared) {
 		b.mu.Unlock()
 		return nil
 	}
@@ -43,13 +132,18 @@ func (b *BackoffPool) Wait(ctx context.Context, timeout time.Duration) error {
 	}
 }
 
+// Reset is called after a successful request. It releases waiting requests
+// unless the delay was set by the server with DelayUntil.
 func (b *BackoffPool) Reset() {
 	b.mu.Lock()
-	b.reset()
+	if !b.fixed {
+		b.reset()
+	}
 	b.backoff = 0
 	b.mu.Unlock()
 }
 func (b *BackoffPool) reset() {
+	b.fixed = false
 	for _, done := range b.queue {
 		close(done)
 	}
@@ -60,49 +154,238 @@ func (b *BackoffPool) reset() {
 	}
 }
 
+// trigger is called with the lock held
 func (b *BackoffPool) trigger(t *time.Timer) {
-	b.mu.Lock()
 	if b.timer != t {
 		// this timer is not the current one
-		b.mu.Unlock()
 		return
 	}
 
 	b.reset()
 	b.backoff = b.backoff * 2
-	if b.backoff > maxBackoff {
-		b.backoff = maxBackoff
+	if b.backoff > b.maxBackoff() {
+		b.backoff = b.maxBackoff()
 	}
-	b.mu.Unlock()
+}
+
+// follow starts waiting for t, the target stored by other processes sharing
+// the pool. Called with the lock held.
+func (b *BackoffPool) follow(t time.Time) bool {
+	if !t.After(time.Now()) {
+		return false
+	}
+	b.target = t
+	b.fixed = true
+	b.setupTimer()
+	return true
+}
+
+func (b *BackoffPool) minBackoff() time.Duration {
+	if b.MinBackoff > 0 {
+		return b.MinBackoff
+	}
+	return defaultMinBackoff
+}
+
+func (b *BackoffPool) maxBackoff() time.Duration {
+	if b.MaxBackoff > 0 {
+		return max(b.MaxBackoff, b.minBackoff())
+	}
+	return max(defaultMaxBackoff, b.minBackoff())
 }
 
 func (b *BackoffPool) Delay() {
+	b.delay(legacyLogger)
+}
+
+func (b *BackoffPool) delay(log *slog.Logger) {
 	b.mu.Lock()
 	if b.timer != nil {
-		minTime := time.Now().Add(minBackoff)
-		if b.target.Before(minTime) {
-			b.target = minTime
-			b.timer.Stop()
-			b.setupTimer()
+		minTime := time.Now().Add(b.minBackoff())
+		if !b.target.Before(minTime) {
+			b.mu.Unlock()
+			return
 		}
-		b.mu.Unlock()
-		return
+		b.target = minTime
+		b.timer.Stop()
+	} else {
+		if b.backoff == 0 {
+			b.backoff = b.minBackoff()
+		}
+		b.target = time.Now().Add(b.backoff)
 	}
+	b.setupTimer()
+	t := b.target
+	b.mu.Unlock()
+	b.store(t, log)
+}
 
-	if b.backoff == 0 {
-		b.backoff = minBackoff
-	}
+// DelayUntil blocks requests waiting on the pool until t, the time the server
+// asked clients to wait for. A delay that is already running is extended but
+// never shortened. If t has already passed, it is the same as Delay.
+func (b *BackoffPool) DelayUntil(t time.Time) {
+	b.delayUntil(t, legacyLogger)
+}
 
-	b.target = time.Now().Add(b.backoff)
+func (b *BackoffPool) delayUntil(t time.Time, log *slog.Logger) {
+	if !t.After(time.Now()) {
+		b.delay(log)
+		return
+	}
+	b.mu.Lock()
+	if b.timer != nil {
+		if !b.target.Before(t) {
+			b.mu.Unlock()
+			return
+		}
+		b.timer.Stop()
+	}
+	b.target = t
+	b.fixed = true
 	b.setupTimer()
-
 	b.mu.Unlock()
+	b.store(t, log)
+}
+
+// store shares target t with other processes. Called without the lock as it
+// accesses the file.
+func (b *BackoffPool) store(t time.Time, log *slog.Logger) {
+	if err := b.shared.store(t); err != nil {
+		log.Warn("failed to store shared backoff", "path", b.shared.path, errAttr(err))
+	}
 }
 
 func (b *BackoffPool) setupTimer() {
+	// t is assigned with the lock held so it can only be read after taking the lock
 	var t *time.Timer
-	b.timer = time.AfterFunc(time.Until(b.target), func() {
+	t = time.AfterFunc(time.Until(b.target), func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
 		b.trigger(t)
 	})
-	t = b.timer
+	b.timer = t
+}
+
+// retryOpt describes how doWithRetries handles the failures of a request.
+type retryOpt struct {
+	// idempotent requests are retried with Opt.RetryPolicy.
+	idempotent bool
+	// rateLimited reports whether the failed response resp was rejected by a
+	// rate limit that delays all clients of the BackoffPool.
+	rateLimited func(resp *http.Response) bool
+}
+
+// doWithRetries sends requests created by newReq until one succeeds or fails
+// with an error that is not retried. Rate limited requests wait in the
+// BackoffPool until the limit resets, if that happens before opt.Timeout.
+// Other failures of idempotent requests are retried with opt.RetryPolicy
+// without delaying other clients of the pool.
+func doWithRetries(ctx context.Context, opt Opt, log *slog.Logger, ro retryOpt, newReq func() (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+	max := time.Now().Add(opt.Timeout)
+	for attempt := 1; ; attempt++ {
+		if err1 := opt.BackoffPool.wait(ctx, time.Until(max), log); err1 != nil {
+			if lastErr != nil {
+				return nil, errors.Wrapf(lastErr, "%v after %d attempts", err1, attempt-1)
+			}
+			return nil, err1
+		}
+		req, err := newReq()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		req = req.WithContext(ctx)
+		url := redactURL(req.URL.String())
+
+		start := time.Now()
+		resp, err := opt.Client.Do(req)
+		if err != nil {
+			log.Debug("request failed", "method", req.Method, "url", url, errAttr(err), "duration", time.Since(start))
+			err = errors.WithStack(err)
+		} else {
+			log.Debug("request", "method", req.Method, "url", url, "status", resp.StatusCode, "duration", time.Since(start))
+			if err = checkResponse(resp); err == nil {
+				opt.BackoffPool.Reset()
+				return resp, nil
+			}
+			resp.Body.Close()
+			if ro.rateLimited(resp) {
+				progressFrom(ctx).retry()
+				if reset, ok := rateLimitReset(resp); ok {
+					if reset.After(max) {
+						return nil, errors.Wrapf(withAttempts(err, attempt), "rate limit resets at %v, after timeout", reset.Format(time.RFC3339))
+					}
+					log.Warn("rate limited, backing off", "method", req.Method, "url", url, "status", resp.StatusCode, "reset", reset.Format(time.RFC3339))
+					opt.BackoffPool.delayUntil(reset, log)
+				} else {
+					log.Warn("rate limited, backing off", "method", req.Method, "url", url, "status", resp.StatusCode)
+					opt.BackoffPool.delay(log)
+				}
+				lastErr = err
+				continue
+			}
+		}
+		d, ok := retryDelay(opt, ro, req, resp, err, attempt)
+		if !ok || time.Now().Add(d).After(max) {
+			if resp != nil {
+				opt.BackoffPool.Reset()
+			}
+			return nil, withAttempts(err, attempt)
+		}
+		log.Warn("retrying request", "method", req.Method, "url", url, "attempt", attempt, "delay", d, errAttr(err))
+		progressFrom(ctx).retry()
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(err, "%v after %d attempts", ctx.Err(), attempt)
+		case <-time.After(d):
+		}
+		lastErr = err
+	}
+}
+
+// retryDelay returns the delay before retrying req. Requests that are not
+// idempotent are never retried.
+func retryDelay(opt Opt, ro retryOpt, req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if !ro.idempotent {
+		return 0, false
+	}
+	if resp != nil {
+		// the error was created from the response
+		err = nil
+	}
+	return opt.RetryPolicy.Retry(req, resp, err, attempt)
+}
+
+// rateLimitReset returns the time a rate limited request can be retried. It
+// handles the Retry-After header used for secondary rate limits and the
+// X-RateLimit-Reset header sent when the primary limit has been exhausted or
+// with a 429 response.
+func rateLimitReset(resp *http.Response) (time.Time, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return time.Time{}, false
+	}
+	if t, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+		return t, true
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if v, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Unix(v, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// retryAfter parses the value of a Retry-After header, either as a number of
+// seconds or as an HTTP date.
+func retryAfter(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+		return time.Now().Add(time.Duration(sec) * time.Second), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
 }
@@ -0,0 +1,243 @@
+package actionscache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExponentialRetryPolicy(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	require.NoError(t, err)
+	p := &ExponentialRetryPolicy{MinBackoff: time.Second, MaxBackoff: 4 * time.Second, MaxAttempts: 5}
+
+	for _, code := range []int{500, 502, 503, 504} {
+		_, ok := p.Retry(req, &http.Response{StatusCode: code}, nil, 1)
+		require.True(t, ok, code)
+	}
+	for _, code := range []int{400, 401, 404, 409, 501} {
+		_, ok := p.Retry(req, &http.Response{StatusCode: code}, nil, 1)
+		require.False(t, ok, code)
+	}
+
+	for attempt, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 4 * time.Second} {
+		d, ok := p.Retry(req, nil, errors.New("connection reset"), attempt)
+		require.True(t, ok)
+		require.GreaterOrEqual(t, d, max/2)
+		require.LessOrEqual(t, d, max)
+	}
+	_, ok := p.Retry(req, nil, errors.New("connection reset"), 5)
+	require.False(t, ok)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	_, ok = p.Retry(req.WithContext(ctx), nil, context.Canceled, 1)
+	require.False(t, ok)
+}
+
+func TestBackoffPoolDelayUntil(t *testing.T) {
+	ctx := context.TODO()
+	b := &BackoffPool{MinBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+
+	start := time.Now()
+	b.DelayUntil(start.Add(300 * time.Millisecond))
+	// the server time is not capped by MaxBackoff or shortened by Delay
+	b.Delay()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		// successful requests don't release a server set delay
+		b.Reset()
+	}()
+	require.NoError(t, b.Wait(ctx, time.Minute))
+	require.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	// configured backoff doubles up to MaxBackoff
+	for _, expected := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond} {
+		start = time.Now()
+		b.Delay()
+		require.NoError(t, b.Wait(ctx, time.Minute))
+		require.GreaterOrEqual(t, time.Since(start), expected)
+		require.Less(t, time.Since(start), expected+200*time.Millisecond)
+	}
+
+	// times in the past back off like Delay
+	b.Reset()
+	start = time.Now()
+	b.DelayUntil(start.Add(-time.Hour))
+	require.NoError(t, b.Wait(ctx, time.Minute))
+	require.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+
+	b.DelayUntil(time.Now().Add(time.Hour))
+	require.ErrorContains(t, b.Wait(ctx, 10*time.Millisecond), "maximum timeout reached")
+}
+
+func TestRateLimitReset(t *testing.T) {
+	resp := func(status int, h ...string) *http.Response {
+		r := &http.Response{StatusCode: status, Header: http.Header{}}
+		for i := 0; i < len(h); i += 2 {
+			r.Header.Set(h[i], h[i+1])
+		}
+		return r
+	}
+	now := time.Now()
+	date := now.Add(time.Hour).UTC().Truncate(time.Second)
+
+	reset, ok := rateLimitReset(resp(http.StatusTooManyRequests, "Retry-After", "30"))
+	require.True(t, ok)
+	require.WithinDuration(t, now.Add(30*time.Second), reset, time.Second)
+
+	reset, ok = rateLimitReset(resp(http.StatusTooManyRequests, "Retry-After", date.Format(http.TimeFormat)))
+	require.True(t, ok)
+	require.Equal(t, date, reset.UTC())
+
+	reset, ok = rateLimitReset(resp(http.StatusTooManyRequests, "X-RateLimit-Reset", "1700000000"))
+	require.True(t, ok)
+	require.Equal(t, int64(1700000000), reset.Unix())
+
+	// 403 needs the limit to be exhausted
+	_, ok = rateLimitReset(resp(http.StatusForbidden, "X-RateLimit-Reset", "1700000000"))
+	require.False(t, ok)
+	_, ok = rateLimitReset(resp(http.StatusForbidden, "X-RateLimit-Reset", "1700000000", "X-RateLimit-Remaining", "0"))
+	require.True(t, ok)
+
+	_, ok = rateLimitReset(resp(http.StatusServiceUnavailable, "Retry-After", "30"))
+	require.False(t, ok)
+	_, ok = rateLimitReset(resp(http.StatusTooManyRequests, "Retry-After", "soon"))
+	require.False(t, ok)
+}
+
+// flakyTransport fails requests to paths containing match with a transport
+// error or a status code until fails requests have failed
+type flakyTransport struct {
+	mu       sync.Mutex
+	match    string
+	status   int
+	header   http.Header
+	fails    int
+	attempts int
+}
+
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.Contains(req.URL.Path, t.match) {
+		t.mu.Lock()
+		t.attempts++
+		fail := t.fails != 0
+		if t.fails > 0 {
+			t.fails--
+		}
+		t.mu.Unlock()
+		if fail {
+			if t.status == 0 {
+				return nil, errors.New("connection reset")
+			}
+			header := http.Header{}
+			for k, v := range t.header {
+				header[k] = v
+			}
+			return &http.Response{
+				StatusCode: t.status,
+				Status:     http.StatusText(t.status),
+				Header:     header,
+				Body:       io.NopCloser(strings.NewReader("{}")),
+				Request:    req,
+			}, nil
+		}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.TODO()
+	s := newTestServer(t)
+	policy := &ExponentialRetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	newCache := func(v2 bool, tr http.RoundTripper) *Cache {
+		c, err := s.newCache(v2, Opt{Client: &http.Client{Transport: tr}, RetryPolicy: policy, UploadChunkSize: 3})
+		require.NoError(t, err)
+		return c
+	}
+
+	// chunk uploads
+	tr := &flakyTransport{match: "/caches/", status: http.StatusServiceUnavailable, fails: 3}
+	require.NoError(t, newCache(false, tr).Save(ctx, "chunks", NewBlob([]byte("0123456789"))))
+	require.Greater(t, tr.attempts, 3)
+
+	// lookups
+	tr = &flakyTransport{match: "/cache", fails: 2}
+	ce, err := newCache(false, tr).Load(ctx, "chunks")
+	require.NoError(t, err)
+	require.NotNil(t, ce)
+	require.Equal(t, 3, tr.attempts)
+
+	// v2 commit
+	tr = &flakyTransport{match: "FinalizeCacheEntryUpload", status: http.StatusBadGateway, fails: 1}
+	require.NoError(t, newCache(true, tr).Save(ctx, "commit", NewBlob([]byte("foo"))))
+	require.Equal(t, 2, tr.attempts)
+
+	// reservations are not retried
+	tr = &flakyTransport{match: "CreateCacheEntry", status: http.StatusInternalServerError, fails: 1}
+	err = newCache(true, tr).Save(ctx, "reserve", NewBlob([]byte("foo")))
+	require.Error(t, err)
+	require.Equal(t, 1, tr.attempts)
+
+	// errors that are not retryable fail right away
+	tr = &flakyTransport{match: "GetCacheEntryDownloadURL", status: http.StatusBadRequest, fails: 1}
+	_, err = newCache(true, tr).Load(ctx, "commit")
+	require.Error(t, err)
+	require.Equal(t, 1, tr.attempts)
+
+	// the number of attempts is reported
+	c, err := s.newCache(true, Opt{
+		Client:      &http.Client{Transport: &flakyTransport{match: "GetCacheEntryDownloadURL", status: http.StatusServiceUnavailable, fails: -1}},
+		RetryPolicy: &ExponentialRetryPolicy{MinBackoff: time.Millisecond, MaxAttempts: 3},
+	})
+	require.NoError(t, err)
+	_, err = c.Load(ctx, "commit")
+	require.ErrorContains(t, err, "failed after 3 attempts")
+	var he HTTPError
+	require.True(t, errors.As(err, &he))
+	require.Equal(t, http.StatusServiceUnavailable, he.StatusCode)
+}
+
+func TestRetryAfter(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, s := newTestCache(t, v2, Opt{})
+		require.NoError(t, c.Save(ctx, "foo", NewBlob([]byte("foo"))))
+
+		match := "/cache"
+		if v2 {
+			match = "GetCacheEntryDownloadURL"
+		}
+		tr := &flakyTransport{match: match, status: http.StatusTooManyRequests, header: http.Header{"Retry-After": []string{"1"}}, fails: 1}
+		pool := &BackoffPool{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		c, err := s.newCache(v2, Opt{Client: &http.Client{Transport: tr}, BackoffPool: pool})
+		require.NoError(t, err)
+
+		start := time.Now()
+		ce, err := c.Load(ctx, "foo")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+		require.Equal(t, 2, tr.attempts)
+		// the server time is used instead of MinBackoff
+		require.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+
+		// reset after the timeout fails without waiting
+		reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		tr = &flakyTransport{match: match, status: http.StatusTooManyRequests, header: http.Header{"X-Ratelimit-Reset": []string{reset}}, fails: 1}
+		c, err = s.newCache(v2, Opt{Client: &http.Client{Transport: tr}, BackoffPool: pool, Timeout: time.Minute})
+		require.NoError(t, err)
+		start = time.Now()
+		_, err = c.Load(ctx, "foo")
+		require.ErrorContains(t, err, "after timeout")
+		require.Less(t, time.Since(start), time.Second)
+		require.Equal(t, 1, tr.attempts)
+	})
+}
@@ -0,0 +1,340 @@
+package actionscache
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer is a minimal cache service for the tests of this package. It
+// serves the v1 and v2 APIs for a single scope and keeps the blobs in memory.
+// actionscachetest can't be used here because it imports this package.
+type testServer struct {
+	URL string
+
+	mu      sync.Mutex
+	entries []*testEntry
+	seq     int
+}
+
+type testEntry struct {
+	id        int
+	key       string
+	version   string
+	data      []byte
+	blocks    map[string][]byte
+	committed bool
+	seq       int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_apis/artifactcache/cache", s.handleLoadV1)
+	mux.HandleFunc("POST /_apis/artifactcache/caches", s.handleReserveV1)
+	mux.HandleFunc("PATCH /_apis/artifactcache/caches/{id}", s.handleUploadV1)
+	mux.HandleFunc("POST /_apis/artifactcache/caches/{id}", s.handleCommitV1)
+	mux.HandleFunc("POST /twirp/github.actions.results.api.v1.CacheService/{method}", s.handleTwirp)
+	mux.HandleFunc("/blob/{id}", s.handleBlob)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	s.URL = srv.URL
+	return s
+}
+
+// newCache returns a client for the server with a token for the main branch
+func (s *testServer) newCache(v2 bool, opt Opt) (*Cache, error) {
+	now := time.Now()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"ac":  `[{"Scope":"refs/heads/main","Permission":3}]`,
+		"nbf": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}).SignedString([]byte("test"))
+	if err != nil {
+		return nil, err
+	}
+	return New(token, s.URL, v2, opt)
+}
+
+// newTestCache starts a testServer and returns a client connected to it
+func newTestCache(t *testing.T, v2 bool, opt Opt) (*Cache, *testServer) {
+	s := newTestServer(t)
+	c, err := s.newCache(v2, opt)
+	require.NoError(t, err)
+	return c, s
+}
+
+// Keys returns the committed keys in the order they were committed.
+func (s *testServer) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []*testEntry
+	for _, e := range s.entries {
+		if e.committed {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+func forEachAPI(t *testing.T, f func(t *testing.T, v2 bool)) {
+	for _, v2 := range []bool{false, true} {
+		name := "v1"
+		if v2 {
+			name = "v2"
+		}
+		t.Run(name, func(t *testing.T) {
+			f(t, v2)
+		})
+	}
+}
+
+func (s *testServer) lookup(keys []string, version string) *testEntry {
+	for _, k := range keys {
+		var match *testEntry
+		for _, e := range s.entries {
+			if !e.committed || e.version != version {
+				continue
+			}
+			if e.key == k {
+				return e
+			}
+			if strings.HasPrefix(e.key, k) && (match == nil || e.seq > match.seq) {
+				match = e
+			}
+		}
+		if match != nil {
+			return match
+		}
+	}
+	return nil
+}
+
+func (s *testServer) reserve(key, version string) *testEntry {
+	for _, e := range s.entries {
+		if e.key == key && e.version == version {
+			return nil
+		}
+	}
+	e := &testEntry{
+		id:      len(s.entries) + 1,
+		key:     key,
+		version: version,
+		blocks:  map[string][]byte{},
+	}
+	s.entries = append(s.entries, e)
+	return e
+}
+
+func (s *testServer) commit(e *testEntry, size int64) bool {
+	if e.committed || int64(len(e.data)) != size {
+		return false
+	}
+	s.seq++
+	e.seq = s.seq
+	e.committed = true
+	return true
+}
+
+func (s *testServer) entry(r *http.Request) *testEntry {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 || id > len(s.entries) {
+		return nil
+	}
+	return s.entries[id-1]
+}
+
+func (s *testServer) blobURL(e *testEntry) string {
+	return fmt.Sprintf("%s/blob/%d?sig=secret", s.URL, e.id)
+}
+
+func (s *testServer) handleLoadV1(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.lookup(strings.Split(q.Get("keys"), ","), q.Get("version"))
+	if e == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeTestJSON(w, http.StatusOK, map[string]string{
+		"cacheKey":        e.key,
+		"scope":           "refs/heads/main",
+		"archiveLocation": s.blobURL(e),
+	})
+}
+
+func (s *testServer) handleReserveV1(w http.ResponseWriter, r *http.Request) {
+	var req ReserveCacheReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.reserve(req.Key, req.Version)
+	if e == nil {
+		writeTestJSON(w, http.StatusConflict, GithubAPIError{
+			Message: "Cache already exists",
+			TypeKey: "ArtifactCacheItemAlreadyExistsException",
+		})
+		return
+	}
+	writeTestJSON(w, http.StatusCreated, ReserveCacheResp{CacheID: e.id})
+}
+
+func (s *testServer) handleUploadV1(w http.ResponseWriter, r *http.Request) {
+	var start, end int64
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/*", &start, &end); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dt, err := io.ReadAll(r.Body)
+	if err != nil || int64(len(dt)) != end-start+1 {
+		http.Error(w, "invalid content range", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(r)
+	if e == nil || e.committed {
+		http.Error(w, "cache not found", http.StatusNotFound)
+		return
+	}
+	if int64(len(e.data)) <= end {
+		e.data = append(e.data, make([]byte, end+1-int64(len(e.data)))...)
+	}
+	copy(e.data[start:], dt)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *testServer) handleCommitV1(w http.ResponseWriter, r *http.Request) {
+	var req CommitCacheReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.entry(r); e == nil || !s.commit(e, req.Size) {
+		http.Error(w, "invalid commit", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *testServer) handleTwirp(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key         string   `json:"key"`
+		RestoreKeys []string `json:"restore_keys"`
+		Version     string   `json:"version"`
+		SizeBytes   int64    `json:"size_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.PathValue("method") {
+	case "CreateCacheEntry":
+		e := s.reserve(req.Key, req.Version)
+		if e == nil {
+			writeTestJSON(w, http.StatusConflict, map[string]string{"code": "already_exists", "msg": "cache entry already exists"})
+			return
+		}
+		writeTestJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "signed_upload_url": s.blobURL(e)})
+	case "FinalizeCacheEntryUpload":
+		for _, e := range s.entries {
+			if e.key == req.Key && e.version == req.Version && s.commit(e, req.SizeBytes) {
+				writeTestJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "entry_id": strconv.Itoa(e.id)})
+				return
+			}
+		}
+		writeTestJSON(w, http.StatusNotFound, map[string]string{"code": "not_found", "msg": "cache entry not found"})
+	case "GetCacheEntryDownloadURL":
+		e := s.lookup(append([]string{req.Key}, req.RestoreKeys...), req.Version)
+		if e == nil {
+			writeTestJSON(w, http.StatusOK, map[string]interface{}{"ok": false})
+			return
+		}
+		writeTestJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "signed_download_url": s.blobURL(e), "matched_key": e.key})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleBlob serves plain HTTP downloads and the subset of the Azure blob API
+// used by the v2 client
+func (s *testServer) handleBlob(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	e := s.entry(r)
+	s.mu.Unlock()
+	if e == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPut {
+		s.mu.Lock()
+		dt := e.data
+		s.mu.Unlock()
+		if rng := r.Header.Get("x-ms-range"); rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(dt))
+		return
+	}
+	dt, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Query().Get("comp") {
+	case "block":
+		e.blocks[r.URL.Query().Get("blockid")] = dt
+	case "blocklist":
+		var bl struct {
+			Blocks []string `xml:",any"`
+		}
+		if err := xml.Unmarshal(dt, &bl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e.data = nil
+		for _, id := range bl.Blocks {
+			e.data = append(e.data, e.blocks[id]...)
+		}
+	default:
+		e.data = dt
+	}
+	w.Header().Set("x-ms-request-id", strconv.Itoa(e.id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func writeTestJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
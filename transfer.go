@@ -0,0 +1,109 @@
+package actionscache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const defaultMaxTransfers = 32
+
+var defaultTransferScheduler = NewTransferScheduler(defaultMaxTransfers)
+
+// DefaultTransferScheduler returns the scheduler shared by all Cache
+// instances that don't set Opt.TransferScheduler. It allows 32 chunk
+// requests in flight by default.
+func DefaultTransferScheduler() *TransferScheduler {
+	return defaultTransferScheduler
+}
+
+// TransferScheduler caps the number of chunk requests in flight across all
+// Cache instances using it. Upload chunks, upload blocks and download ranges
+// each take a slot while the request is running. Waiting requests are served
+// in order.
+type TransferScheduler struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiters []chan struct{}
+}
+
+// NewTransferScheduler returns a scheduler allowing limit requests in
+// flight. A limit of zero or less does not limit requests.
+func NewTransferScheduler(limit int) *TransferScheduler {
+	return &TransferScheduler{limit: limit}
+}
+
+// SetLimit changes the number of requests allowed in flight. Requests already
+// running are not interrupted when the limit is lowered.
+func (s *TransferScheduler) SetLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.wake()
+}
+
+// InFlight returns the number of requests currently holding a slot.
+func (s *TransferScheduler) InFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+func (s *TransferScheduler) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if len(s.waiters) == 0 && s.available() {
+		s.active++
+		s.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	s.waiters = append(s.waiters, ch)
+	s.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, w := range s.waiters {
+			if w == ch {
+				s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+				return errors.WithStack(ctx.Err())
+			}
+		}
+		// the slot was granted while cancelling
+		s.active--
+		s.wake()
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+func (s *TransferScheduler) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.wake()
+}
+
+// available is called with the lock held
+func (s *TransferScheduler) available() bool {
+	return s.limit <= 0 || s.active < s.limit
+}
+
+// wake grants free slots to waiters. Called with the lock held.
+func (s *TransferScheduler) wake() {
+	for len(s.waiters) > 0 && s.available() {
+		s.active++
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+	}
+}
@@ -0,0 +1,177 @@
+package actionscache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestTransferScheduler(t *testing.T) {
+	ctx := context.TODO()
+	s := NewTransferScheduler(2)
+	require.NoError(t, s.acquire(ctx))
+	require.NoError(t, s.acquire(ctx))
+	require.Equal(t, 2, s.InFlight())
+
+	acquired := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			assert.NoError(t, s.acquire(ctx))
+			acquired <- i
+		}()
+		// waiters are served in order
+		require.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(s.waiters) == i+1
+		}, time.Second, time.Millisecond)
+	}
+
+	s.release()
+	require.Equal(t, 0, <-acquired)
+	require.Equal(t, 2, s.InFlight())
+
+	// raising the limit wakes waiters
+	s.SetLimit(3)
+	require.Equal(t, 1, <-acquired)
+	require.Equal(t, 3, s.InFlight())
+
+	// cancelled waiters don't take a slot
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.acquire(cctx), context.DeadlineExceeded)
+	require.Equal(t, 3, s.InFlight())
+
+	for i := 0; i < 3; i++ {
+		s.release()
+	}
+	require.Equal(t, 0, s.InFlight())
+
+	s.SetLimit(0)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.acquire(ctx))
+	}
+	require.Equal(t, 100, s.InFlight())
+
+	var nilScheduler *TransferScheduler
+	require.NoError(t, nilScheduler.acquire(ctx))
+	nilScheduler.release()
+}
+
+func TestOptValidate(t *testing.T) {
+	for _, opt := range []Opt{
+		{UploadConcurrency: -1},
+		{UploadChunkSize: -1},
+		{UploadChunkSize: maxUploadChunkSize + 1},
+		{DownloadConcurrency: -1},
+		{DownloadChunkSize: -1},
+	} {
+		require.Error(t, opt.validate(), "%+v", opt)
+	}
+	require.NoError(t, Opt{}.validate())
+
+	opt := optsWithDefaults(Opt{DownloadChunkSize: 7})
+	require.Equal(t, 4, opt.UploadConcurrency)
+	require.Equal(t, int64(32*1024*1024), opt.UploadChunkSize)
+	require.Equal(t, 4, opt.DownloadConcurrency)
+	require.Equal(t, int64(7), opt.DownloadChunkSize)
+	require.Equal(t, defaultTransferScheduler, opt.TransferScheduler)
+}
+
+// concurrencyTransport records the highest number of concurrent upload
+// chunk and download range requests
+type concurrencyTransport struct {
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (t *concurrencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// size probes of a single byte are not chunk requests
+	chunk := req.Method == http.MethodPatch ||
+		(strings.HasPrefix(req.URL.Path, "/blob/") && req.Header.Get("Range") != "bytes=0-0")
+	if chunk {
+		t.mu.Lock()
+		t.current++
+		t.max = max(t.max, t.current)
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			t.current--
+			t.mu.Unlock()
+		}()
+		// keep requests in flight long enough to overlap
+		time.Sleep(5 * time.Millisecond)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || !chunk {
+		return resp, err
+	}
+	// count the request until the body has been read
+	dt, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(dt))
+	return resp, err
+}
+
+// TestSharedTransferScheduler uses the v1 API because the Azure client of the
+// v2 API does not use Opt.Client.
+func TestSharedTransferScheduler(t *testing.T) {
+	ctx := context.TODO()
+	s := newTestServer(t)
+
+	tr := &concurrencyTransport{}
+	sched := NewTransferScheduler(2)
+	opt := Opt{
+		Client:              &http.Client{Transport: tr},
+		UploadConcurrency:   4,
+		UploadChunkSize:     3,
+		DownloadConcurrency: 4,
+		DownloadChunkSize:   3,
+		TransferScheduler:   sched,
+	}
+	c1, err := s.newCache(false, opt)
+	require.NoError(t, err)
+	c2, err := s.newCache(false, opt)
+	require.NoError(t, err)
+
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	var eg errgroup.Group
+	for i, c := range []*Cache{c1, c2} {
+		eg.Go(func() error {
+			key := fmt.Sprintf("sched-%d", i)
+			if err := c.Save(ctx, key, NewBlob(data)); err != nil {
+				return err
+			}
+			ce, err := c.Load(ctx, key)
+			if err != nil {
+				return err
+			}
+			wa := make(writerAt, len(data))
+			if err := ce.DownloadTo(ctx, wa, DownloadOpt{}); err != nil {
+				return err
+			}
+			if !bytes.Equal(data, wa) {
+				return errors.Errorf("invalid data %q", wa)
+			}
+			return nil
+		})
+	}
+	require.NoError(t, eg.Wait())
+	require.Equal(t, 0, sched.InFlight())
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	require.Equal(t, 2, tr.max)
+}
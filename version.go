@@ -0,0 +1,80 @@
+package actionscache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"runtime"
+	"strings"
+)
+
+// ToolkitCompression is the compression method of caches saved by the
+// actions/cache action. It is part of the cache version.
+type ToolkitCompression string
+
+const (
+	ToolkitGzip            ToolkitCompression = "gzip"
+	ToolkitZstdWithoutLong ToolkitCompression = "zstd-without-long"
+	ToolkitZstd            ToolkitCompression = "zstd"
+)
+
+// toolkitVersionSalt is changed by the toolkit to invalidate all caches
+const toolkitVersionSalt = "1.0"
+
+// ToolkitVersion returns the cache version the actions/toolkit cache package
+// computes for paths and compression. Using it as Opt.Version makes caches
+// interchangeable with actions/cache steps that use the same paths. Unless
+// crossOS is set, caches saved on Windows are only visible on Windows.
+func ToolkitVersion(paths []string, compression ToolkitCompression, crossOS bool) string {
+	components := append([]string{}, paths...)
+	if compression != "" {
+		components = append(components, string(compression))
+	}
+	if runtime.GOOS == "windows" && !crossOS {
+		components = append(components, "windows-only")
+	}
+	components = append(components, toolkitVersionSalt)
+	dgst := sha256.Sum256([]byte(strings.Join(components, "|")))
+	return hex.EncodeToString(dgst[:])
+}
+
+// defaultVersion is the version of entries saved without Opt.Version
+var defaultVersion = func() string {
+	dgst := sha256.Sum256([]byte("|go-actionscache-1.0"))
+	return hex.EncodeToString(dgst[:])
+}()
+
+func (c *Cache) version() string {
+	if c.opt.Version != "" {
+		return c.opt.Version
+	}
+	return defaultVersion
+}
+
+// WithVersion returns a copy of the cache that saves and loads entries with
+// version v.
+func (c *Cache) WithVersion(v string) *Cache {
+	return c.withOpt(func(opt *Opt) {
+		opt.Version = v
+	})
+}
+
+// Plain returns a copy of the cache that saves data as is, without the
+// compression, encryption or digest configured in Opt, so that the entries can
+// be read by other clients such as actions/cache. Loading is not affected.
+func (c *Cache) Plain() *Cache {
+	c2 := c.withOpt(func(*Opt) {})
+	c2.plain = true
+	return c2
+}
+
+func (c *Cache) withOpt(f func(*Opt)) *Cache {
+	c2 := *c
+	f(&c2.opt)
+	switch c.backend.(type) {
+	case *backendV1:
+		c2.backend = &backendV1{&c2}
+	case *backendV2:
+		c2.backend = &backendV2{&c2}
+	}
+	return &c2
+}
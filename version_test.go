@@ -0,0 +1,49 @@
+package actionscache
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestToolkitVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows-only caches have a different version")
+	}
+	require.Equal(t, "273877e14fd65d270b87a198edbfa2db5a43de567c9a548d2a2505b408befe24",
+		ToolkitVersion([]string{"node_modules"}, ToolkitZstd, false))
+	require.Equal(t, "60bd089e35417b4f8f2bbe172166ebd6cd2491fae19bedbac3555cb36943db0d",
+		ToolkitVersion([]string{"~/.cache/go-build", "~/go/pkg/mod"}, ToolkitGzip, true))
+	require.Equal(t, "37edffbf24856aa98c2c1c41362a68951b2eab789f9e2e5997365c28b393b098",
+		ToolkitVersion([]string{"a"}, "", false))
+}
+
+func TestVersion(t *testing.T) {
+	forEachAPI(t, func(t *testing.T, v2 bool) {
+		ctx := context.TODO()
+		c, _ := newTestCache(t, v2, Opt{})
+		v := ToolkitVersion([]string{"node_modules"}, ToolkitZstd, true)
+		cv := c.WithVersion(v)
+
+		err := cv.Save(ctx, "npm-linux", NewBlob([]byte("foo")))
+		require.NoError(t, err)
+
+		ce, err := c.Load(ctx, "npm-")
+		require.NoError(t, err)
+		require.Nil(t, ce)
+
+		ce, err = cv.Load(ctx, "npm-")
+		require.NoError(t, err)
+		require.NotNil(t, ce)
+		require.Equal(t, "npm-linux", ce.Key)
+
+		// the same key can exist in both versions
+		err = c.Save(ctx, "npm-linux", NewBlob([]byte("bar")))
+		require.NoError(t, err)
+		err = cv.Save(ctx, "npm-linux", NewBlob([]byte("baz")))
+		require.ErrorIs(t, err, os.ErrExist)
+	})
+}